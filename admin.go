@@ -0,0 +1,324 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"omiro/middleware"
+	"omiro/redis"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// registerAdminRoutes serves the /admin API. Everything it reports comes
+// from Redis, so any server can answer for the whole cluster; actions are
+// forwarded to the server holding the client.
+func registerAdminRoutes(e *echo.Echo) {
+	g := e.Group("/admin", echo.WrapMiddleware(middleware.AdminAuth(cfg.Admin.Token)))
+	g.GET("/servers", handleAdminServers)
+	g.GET("/servers/:id/clients", handleAdminServerClients)
+	g.GET("/queue", handleAdminQueue)
+	g.GET("/clients", handleAdminClients)
+	g.GET("/clients/:id", handleAdminClient)
+	g.POST("/clients/:id/kick", handleAdminKick)
+	g.POST("/clients/:id/unpair", handleAdminUnpair)
+	g.GET("/bans", handleAdminBans)
+	g.POST("/bans", handleAdminBan)
+	g.DELETE("/bans/:kind/:value", handleAdminUnban)
+	g.GET("/reports", handleAdminReports)
+	g.POST("/reports/:id/resolve", handleAdminResolveReport)
+	g.POST("/broadcast", handleAdminBroadcast)
+	g.GET("/maintenance", handleAdminMaintenance)
+	g.PUT("/maintenance", handleAdminSetMaintenance)
+	g.GET("/stats", handleAdminStats)
+}
+
+func handleAdminServers(c echo.Context) error {
+	infos, err := redis.ServerInfos(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list servers"})
+	}
+	slices.SortFunc(infos, func(a, b redis.ServerInfo) int { return cmp.Compare(a.ID, b.ID) })
+
+	now := time.Now()
+	out := make([]map[string]any, 0, len(infos))
+	for _, s := range infos {
+		out = append(out, map[string]any{
+			"id":             s.ID,
+			"last_heartbeat": s.LastHeartbeat,
+			"heartbeat_age":  int64(now.Sub(time.Unix(s.LastHeartbeat, 0)).Seconds()),
+			"clients":        s.Clients,
+			"self":           s.ID == serverID,
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]any{"servers": out})
+}
+
+func handleAdminServerClients(c echo.Context) error {
+	id := c.Param("id")
+	metas, err := redis.ServerClients(c.Request().Context(), id)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list clients"})
+	}
+	slices.SortFunc(metas, func(a, b redis.ClientMeta) int { return cmp.Compare(a.ConnectedAt, b.ConnectedAt) })
+	if metas == nil {
+		metas = []redis.ClientMeta{}
+	}
+	return c.JSON(http.StatusOK, map[string]any{"server_id": id, "clients": metas})
+}
+
+// handleAdminQueue lists every client waiting for a match, longest-waiting
+// first, across all live servers.
+func handleAdminQueue(c echo.Context) error {
+	ctx := c.Request().Context()
+	servers, err := redis.ListServers(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list servers"})
+	}
+
+	queued := []redis.ClientMeta{}
+	for _, id := range servers {
+		metas, err := redis.ServerClients(ctx, id)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list clients"})
+		}
+		for _, m := range metas {
+			if m.InQueue {
+				queued = append(queued, m)
+			}
+		}
+	}
+	slices.SortFunc(queued, func(a, b redis.ClientMeta) int { return cmp.Compare(a.QueuedAt, b.QueuedAt) })
+
+	return c.JSON(http.StatusOK, map[string]any{"length": len(queued), "entries": queued})
+}
+
+func handleAdminClient(c echo.Context) error {
+	meta, err := redis.GetClient(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return adminClientError(c, err)
+	}
+	return c.JSON(http.StatusOK, meta)
+}
+
+// handleAdminKick closes a client's connection. The client may reconnect
+// with a fresh session; ban or revoke it first to keep it out.
+func handleAdminKick(c echo.Context) error {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request().ContentLength > 0 {
+		if err := c.Bind(&body); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+	}
+
+	meta, err := redis.KickClient(c.Request().Context(), c.Param("id"), body.Reason)
+	if meta == nil {
+		return adminClientError(c, err)
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to reach server"})
+	}
+
+	slog.Info("admin kicked client", "client_id", meta.ID, "target_server", meta.ServerID, "reason", body.Reason)
+	return c.JSON(http.StatusAccepted, map[string]string{"status": "kick sent", "server_id": meta.ServerID})
+}
+
+// handleAdminUnpair ends a client's current pairing. Both sides get
+// partner_disconnected and are free to queue again.
+func handleAdminUnpair(c echo.Context) error {
+	meta, err := redis.UnpairClient(c.Request().Context(), c.Param("id"))
+	switch {
+	case meta == nil:
+		return adminClientError(c, err)
+	case errors.Is(err, redis.ErrNotPaired):
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Client is not paired"})
+	case err != nil:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to reach server"})
+	}
+
+	slog.Info("admin unpaired client", "client_id", meta.ID, "partner_id", meta.PartnerID, "target_server", meta.ServerID)
+	return c.JSON(http.StatusAccepted, map[string]string{"status": "unpair sent", "server_id": meta.ServerID})
+}
+
+func handleAdminClients(c echo.Context) error {
+	metas, err := redis.AllClients(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list clients"})
+	}
+	slices.SortFunc(metas, func(a, b redis.ClientMeta) int { return cmp.Compare(a.ConnectedAt, b.ConnectedAt) })
+	if metas == nil {
+		metas = []redis.ClientMeta{}
+	}
+	return c.JSON(http.StatusOK, map[string]any{"clients": metas})
+}
+
+func handleAdminBans(c echo.Context) error {
+	bans, err := redis.ListBans(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list bans"})
+	}
+	if bans == nil {
+		bans = []redis.Ban{}
+	}
+	return c.JSON(http.StatusOK, map[string]any{"bans": bans})
+}
+
+// handleAdminBan bans an IP, user or device and drops its live
+// connections. Duration is a Go duration; empty or "0" never expires.
+func handleAdminBan(c echo.Context) error {
+	var body struct {
+		Kind     string `json:"kind"`
+		Value    string `json:"value"`
+		Duration string `json:"duration"`
+		Reason   string `json:"reason"`
+	}
+	if err := c.Bind(&body); err != nil || body.Value == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	var duration time.Duration
+	if body.Duration != "" {
+		d, err := time.ParseDuration(body.Duration)
+		if err != nil || d < 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid duration"})
+		}
+		duration = d
+	}
+
+	switch body.Kind {
+	case "ip", "user", "device":
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Kind must be ip, user or device"})
+	}
+	if err := middleware.Ban(c.Request().Context(), body.Kind, body.Value, duration, body.Reason); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store ban"})
+	}
+
+	slog.Info("admin added ban", "kind", body.Kind, "duration", duration, "reason", body.Reason)
+	return c.JSON(http.StatusCreated, map[string]string{"status": "banned"})
+}
+
+func handleAdminUnban(c echo.Context) error {
+	value, err := url.PathUnescape(c.Param("value"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ban value"})
+	}
+	ok, err := redis.Unban(c.Request().Context(), c.Param("kind"), value)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Ban not found"})
+	}
+
+	slog.Info("admin removed ban", "kind", c.Param("kind"))
+	return c.JSON(http.StatusOK, map[string]string{"status": "unbanned"})
+}
+
+// handleAdminReports lists open moderation reports, or all of them with
+// ?all=1.
+func handleAdminReports(c echo.Context) error {
+	reports, err := redis.ListReports(c.Request().Context(), c.QueryParam("all") != "")
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list reports"})
+	}
+	return c.JSON(http.StatusOK, map[string]any{"reports": reports})
+}
+
+func handleAdminResolveReport(c echo.Context) error {
+	ok, err := redis.ResolveReport(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to resolve report"})
+	}
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Report not found"})
+	}
+
+	slog.Info("admin resolved report", "report_id", c.Param("id"))
+	return c.JSON(http.StatusOK, map[string]string{"status": "resolved"})
+}
+
+// handleAdminBroadcast sends an announcement to every connected client.
+// With expires_in (a Go duration) or expires_at it is also shown to
+// clients that connect before it expires.
+func handleAdminBroadcast(c echo.Context) error {
+	var body struct {
+		redis.Announcement
+		ExpiresIn string `json:"expires_in"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	a := body.Announcement
+	if a.Severity == "" {
+		a.Severity = "info"
+	}
+	if body.ExpiresIn != "" {
+		d, err := time.ParseDuration(body.ExpiresIn)
+		if err != nil || d <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid expires_in"})
+		}
+		a.ExpiresAt = time.Now().Add(d).Unix()
+	}
+	if err := a.Validate(); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err := redis.Announce(c.Request().Context(), a); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to broadcast"})
+	}
+
+	slog.Info("admin broadcast announcement", "severity", a.Severity, "expires_at", a.ExpiresAt)
+	return c.JSON(http.StatusAccepted, map[string]string{"status": "broadcast sent"})
+}
+
+func handleAdminMaintenance(c echo.Context) error {
+	m, err := redis.GetMaintenance(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to read maintenance mode"})
+	}
+	return c.JSON(http.StatusOK, m)
+}
+
+// handleAdminSetMaintenance turns maintenance mode on or off. While it is
+// on, /session/new and join_queue are refused with message; calls already
+// in progress continue.
+func handleAdminSetMaintenance(c echo.Context) error {
+	var body struct {
+		Enabled bool   `json:"enabled"`
+		Message string `json:"message"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	}
+	ctx := c.Request().Context()
+	if err := redis.SetMaintenance(ctx, body.Enabled, body.Message); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to set maintenance mode"})
+	}
+
+	slog.Info("admin set maintenance mode", "enabled", body.Enabled)
+	m, err := redis.GetMaintenance(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to read maintenance mode"})
+	}
+	return c.JSON(http.StatusOK, m)
+}
+
+func handleAdminStats(c echo.Context) error {
+	stats, err := redis.ClusterStats(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to collect stats"})
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
+func adminClientError(c echo.Context, err error) error {
+	if err.Error() == "redis: nil" {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Client not found"})
+	}
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load client"})
+}
@@ -1,14 +1,64 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
-	"log"
+	"omiro/config"
+	"omiro/filter"
+	"omiro/metrics"
+	"omiro/redis"
+	"os"
+	"strings"
 
-	"github.com/gorilla/websocket"
+	"github.com/google/uuid"
 )
 
-func handleChat(c *Client, data json.RawMessage) {
+var chatFilters filter.Pipeline
+
+func loadChatFilters(c config.ChatConfig) (filter.Pipeline, error) {
+	fc := filter.Config{
+		Enabled:       c.Filters,
+		LinkAllowlist: c.LinkAllowlist,
+		SpamPartners:  c.SpamPartners,
+		SpamWindow:    c.SpamWindow,
+	}
+
+	if c.ProfanityFile != "" {
+		raw, err := os.ReadFile(c.ProfanityFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(raw), "\n") {
+			if w := strings.TrimSpace(line); w != "" && !strings.HasPrefix(w, "#") {
+				fc.ProfanityWords = append(fc.ProfanityWords, w)
+			}
+		}
+	}
+
+	for _, kind := range c.PII {
+		switch kind {
+		case "phone":
+			fc.RedactPhones = true
+		case "email":
+			fc.RedactEmails = true
+		}
+	}
+
+	var err error
+	if fc.ProfanityAction, err = filter.ParseAction(c.ProfanityAction); err != nil {
+		return nil, err
+	}
+	if fc.LinkAction, err = filter.ParseAction(c.LinkAction); err != nil {
+		return nil, err
+	}
+	if fc.SpamAction, err = filter.ParseAction(c.SpamAction); err != nil {
+		return nil, err
+	}
+
+	return filter.New(fc)
+}
+
+func handleChat(ctx context.Context, c *Client, data json.RawMessage) {
 	var payload struct {
 		Message string `json:"message"`
 	}
@@ -16,20 +66,88 @@ func handleChat(c *Client, data json.RawMessage) {
 	partner := c.Partner
 	clientsMu.RUnlock()
 	if partner == nil {
-		log.Println("partner not found:", c.ID)
+		c.logger().Debug("chat without partner")
 		return
 	}
 	if err := json.Unmarshal(data, &payload); err != nil {
-		log.Println("chat payload invalid:", err)
+		c.logger().Warn("invalid payload", "op", "chat", "err", err)
 		return
 	}
 
-	log.Printf("[%s] says: %s\n", c.ID, payload.Message)
-	partner.Send <- SendMessageType{
-		Message: fmt.Appendf(nil,
-			`{"op":"chat","message":"%s"}`, payload.Message,
-		),
-		Type: websocket.TextMessage,
+	res := chatFilters.Run(filter.Message{
+		SenderID:  c.ID,
+		Sender:    c.sender(),
+		PartnerID: partner.ID,
+		Text:      payload.Message,
+	})
+
+	switch res.Action {
+	case filter.Block:
+		c.logger().Info("chat blocked", "filter", res.Filter)
+		metrics.ChatMessages.WithLabelValues("text", "blocked").Inc()
+		sendJSON(c, map[string]any{
+			"op":     "chat_blocked",
+			"reason": res.Reason,
+		})
+		return
+	case filter.Flag:
+		c.logger().Info("chat flagged", "filter", res.Filter)
+		if _, err := redis.CreateReport(ctx, redis.Report{
+			ClientID: c.ID,
+			IP:       c.IP,
+			DeviceID: c.Session.DeviceID(),
+			Reason:   res.Filter + ": " + res.Reason,
+			Evidence: payload.Message,
+		}); err != nil {
+			c.logger().Error("failed to store moderation report", "err", err)
+		}
+	}
+
+	id := uuid.NewString()
+
+	// sending a message ends the typing indicator
+	c.mu.Lock()
+	c.typing = false
+	c.mu.Unlock()
+
+	partner.mu.Lock()
+	partner.rememberReceived(id)
+	partner.mu.Unlock()
+
+	if err := redis.StoreChatMessage(ctx, c.RoomID, redis.ChatMessage{
+		ID:       id,
+		SenderID: c.ID,
+		Message:  res.Text,
+	}, payload.Message); err != nil {
+		c.logger().Error("failed to store chat message", "err", err)
 	}
 
+	c.logger().Debug("chat delivered", "partner_id", partner.ID, "message_id", id)
+	metrics.ChatMessages.WithLabelValues("text", "delivered").Inc()
+	sendJSON(partner, map[string]any{
+		"op":      "chat",
+		"id":      id,
+		"message": res.Text,
+	})
+	sendJSON(c, map[string]any{
+		"op": "chat_sent",
+		"id": id,
+	})
+}
+
+func sendError(c *Client, code, message string) {
+	sendJSON(c, map[string]any{
+		"op":      "error",
+		"code":    code,
+		"message": message,
+	})
+}
+
+func sendJSON(c *Client, msg any) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		c.logger().Error("json marshal error", "err", err)
+		return
+	}
+	c.enqueue(b)
 }
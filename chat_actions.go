@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"omiro/filter"
+	"omiro/redis"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// authors may edit or delete their messages for this long after sending
+	chatEditWindow = 5 * time.Minute
+	maxReactionLen = 16
+)
+
+// chatRefusal is why a change to a message was refused. It is sent back to
+// the client as an error op.
+type chatRefusal struct {
+	code    string
+	message string
+}
+
+func (e *chatRefusal) Error() string { return e.message }
+
+var (
+	errMessageNotFound   = &chatRefusal{"message_not_found", "Message not found"}
+	errNotAuthor         = &chatRefusal{"not_author", "Only the author can change this message"}
+	errMessageDeleted    = &chatRefusal{"message_deleted", "Message was deleted"}
+	errEditWindowExpired = &chatRefusal{"edit_window_expired", "Message is too old to change"}
+	errNotEditable       = &chatRefusal{"not_editable", "Media messages can't be edited"}
+)
+
+// checkOwnMessage reports why c may not change msg, or nil if c wrote it
+// recently enough to change it.
+func checkOwnMessage(c *Client, msg *redis.ChatMessage) error {
+	if msg.SenderID != c.ID {
+		return errNotAuthor
+	}
+	if msg.Deleted {
+		return errMessageDeleted
+	}
+	if time.Since(time.Unix(msg.Timestamp, 0)) > chatEditWindow {
+		return errEditWindowExpired
+	}
+	return nil
+}
+
+// loadOwnMessage fetches a message from the current room and checks that c
+// may change it, so obviously bad requests are refused before any work.
+func loadOwnMessage(ctx context.Context, c *Client, id string) *redis.ChatMessage {
+	msg, err := redis.GetChatMessage(ctx, c.RoomID, id)
+	if err != nil {
+		refuse(c, errMessageNotFound)
+		return nil
+	}
+	if err := checkOwnMessage(c, msg); err != nil {
+		refuse(c, err)
+		return nil
+	}
+	return msg
+}
+
+// updateChatMessage applies fn to a message in c's room atomically. fn
+// sees the latest version and returns a chatRefusal to leave it alone. It
+// returns the saved message, or nil if nothing was saved.
+func updateChatMessage(ctx context.Context, c *Client, id, op string, fn func(*redis.ChatMessage) error) *redis.ChatMessage {
+	msg, err := redis.UpdateChatMessage(ctx, c.RoomID, id, fn)
+	if err != nil {
+		if errors.Is(err, redis.ErrMessageNotFound) {
+			err = errMessageNotFound
+		}
+		if !refuse(c, err) {
+			c.logger().Error("failed to update chat message", "op", op, "err", err)
+		}
+		return nil
+	}
+	return msg
+}
+
+// refuse sends err to c if it is a chatRefusal, and reports whether it was.
+func refuse(c *Client, err error) bool {
+	var refusal *chatRefusal
+	if !errors.As(err, &refusal) {
+		return false
+	}
+	sendError(c, refusal.code, refusal.message)
+	return true
+}
+
+func handleChatEdit(ctx context.Context, c *Client, data json.RawMessage) {
+	var payload struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil || payload.ID == "" {
+		c.logger().Warn("invalid payload", "op", "chat_edit", "err", err)
+		return
+	}
+
+	clientsMu.RLock()
+	partner := c.Partner
+	clientsMu.RUnlock()
+	if partner == nil {
+		return
+	}
+
+	msg := loadOwnMessage(ctx, c, payload.ID)
+	if msg == nil {
+		return
+	}
+	if msg.Media != "" {
+		refuse(c, errNotEditable)
+		return
+	}
+
+	// edits go through the same filters as new messages
+	res := chatFilters.Run(filter.Message{
+		SenderID:  c.ID,
+		Sender:    c.sender(),
+		PartnerID: partner.ID,
+		Text:      payload.Message,
+	})
+	if res.Action == filter.Block {
+		sendJSON(c, map[string]any{
+			"op":     "chat_blocked",
+			"id":     payload.ID,
+			"reason": res.Reason,
+		})
+		return
+	}
+	if res.Action == filter.Flag {
+		if _, err := redis.CreateReport(ctx, redis.Report{
+			ClientID: c.ID,
+			IP:       c.IP,
+			DeviceID: c.Session.DeviceID(),
+			Reason:   res.Filter + ": " + res.Reason,
+			Evidence: payload.Message,
+		}); err != nil {
+			c.logger().Error("failed to store moderation report", "err", err)
+		}
+	}
+
+	msg = updateChatMessage(ctx, c, payload.ID, "chat_edit", func(m *redis.ChatMessage) error {
+		if err := checkOwnMessage(c, m); err != nil {
+			return err
+		}
+		if m.Media != "" {
+			return errNotEditable
+		}
+		m.Message = res.Text
+		m.EditedAt = time.Now().Unix()
+		return nil
+	})
+	if msg == nil {
+		return
+	}
+
+	sendJSON(partner, map[string]any{
+		"op":        "chat_edit",
+		"id":        msg.ID,
+		"message":   msg.Message,
+		"edited_at": msg.EditedAt,
+	})
+}
+
+func handleChatDelete(ctx context.Context, c *Client, data json.RawMessage) {
+	var payload struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil || payload.ID == "" {
+		c.logger().Warn("invalid payload", "op", "chat_delete", "err", err)
+		return
+	}
+
+	clientsMu.RLock()
+	partner := c.Partner
+	clientsMu.RUnlock()
+	if partner == nil {
+		return
+	}
+
+	msg := updateChatMessage(ctx, c, payload.ID, "chat_delete", func(m *redis.ChatMessage) error {
+		if err := checkOwnMessage(c, m); err != nil {
+			return err
+		}
+		m.Deleted = true
+		m.Message = ""
+		m.Media = ""
+		m.Reactions = nil
+		return nil
+	})
+	if msg == nil {
+		return
+	}
+
+	sendJSON(partner, map[string]any{
+		"op": "chat_delete",
+		"id": msg.ID,
+	})
+}
+
+func handleChatReact(ctx context.Context, c *Client, data json.RawMessage) {
+	var payload struct {
+		ID    string `json:"id"`
+		Emoji string `json:"emoji"` // empty removes the reaction
+	}
+	if err := json.Unmarshal(data, &payload); err != nil || payload.ID == "" {
+		c.logger().Warn("invalid payload", "op", "chat_react", "err", err)
+		return
+	}
+	if len(payload.Emoji) > maxReactionLen || !utf8.ValidString(payload.Emoji) {
+		sendError(c, "invalid_reaction", "Invalid reaction")
+		return
+	}
+
+	clientsMu.RLock()
+	partner := c.Partner
+	clientsMu.RUnlock()
+	if partner == nil {
+		return
+	}
+
+	msg := updateChatMessage(ctx, c, payload.ID, "chat_react", func(m *redis.ChatMessage) error {
+		if m.Deleted {
+			return errMessageNotFound
+		}
+		if payload.Emoji == "" {
+			delete(m.Reactions, c.ID)
+		} else {
+			if m.Reactions == nil {
+				m.Reactions = make(map[string]string)
+			}
+			m.Reactions[c.ID] = payload.Emoji
+		}
+		return nil
+	})
+	if msg == nil {
+		return
+	}
+
+	sendJSON(partner, map[string]any{
+		"op":    "chat_react",
+		"id":    msg.ID,
+		"from":  c.ID,
+		"emoji": payload.Emoji,
+	})
+}
@@ -1,17 +1,39 @@
 package main
 
 import (
-	"log"
+	"log/slog"
+	"omiro/metrics"
+	"omiro/middleware"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Client struct {
-	ID      string
-	Conn    *websocket.Conn
-	Send    chan SendMessageType
-	Partner *Client
+	ID        string
+	Session   *middleware.Session
+	IP        string
+	Conn      *websocket.Conn
+	Send      chan SendMessageType
+	Partner   *Client
+	RoomID    string // shared by both sides of the current pairing
+	Mode      string // video, audio or text, declared on join_queue
+
+	mu          sync.Mutex
+	typing      bool
+	lastTyping  time.Time
+	typingStop  *time.Timer // a typing_stop waiting out typingMinInterval
+	received    []string    // IDs of the latest chat messages delivered to this client
+	queuedAt    time.Time   // when the client last joined the queue
+	pairedAt    time.Time   // when the current pairing was made
+	connectedAt time.Time   // when the WebSocket was accepted
+	closeReason string      // why the connection ended, for metrics
+
+	// upgrade is the span of the handshake, linked from every message span
+	// so a trace can be followed back to how the client connected.
+	upgrade trace.SpanContext
 }
 
 type SendMessageType struct {
@@ -20,14 +42,14 @@ type SendMessageType struct {
 }
 
 func (c *Client) writePump() {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(cfg.WebSocket.PingInterval)
 	defer func() {
 		ticker.Stop()
 		clientsMu.Lock()
 		delete(clients, c.ID)
 		clientsMu.Unlock()
 		c.Conn.Close()
-		log.Println("client disconnected (writePump):", c.ID)
+		c.logger().Debug("write pump stopped")
 	}()
 
 	for {
@@ -40,16 +62,93 @@ func (c *Client) writePump() {
 
 		err := c.Conn.WriteMessage(msg.Type, msg.Message)
 		if err != nil {
-			log.Printf("error writing message to %s: %s\n", c.ID, err)
+			c.setCloseReason("write_error")
+			c.logger().Warn("write failed", "err", err)
 			return
 			}
 
 		case <-ticker.C:
-			log.Printf("📡 Sending ping to client %s\n", c.ID)
+			c.logger().Debug("sending ping")
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.Printf("❌ Ping failed for %s: %s\n", c.ID, err)
+				c.setCloseReason("ping_failed")
+				c.logger().Warn("ping failed", "err", err)
 				return
 			}
 		}
 	}
 }
+
+// logger tags log lines with the client's ID.
+func (c *Client) logger() *slog.Logger {
+	return slog.With("client_id", c.ID)
+}
+
+// enqueue hands msg to writePump without blocking. If the client isn't
+// keeping up and its queue is full, the message is dropped.
+func (c *Client) enqueue(msg []byte) bool {
+	select {
+	case c.Send <- SendMessageType{Type: websocket.TextMessage, Message: msg}:
+		return true
+	default:
+		metrics.SendDrops.Inc()
+		c.logger().Warn("send queue full, message dropped")
+		return false
+	}
+}
+
+// setCloseReason records why the connection is ending. The first reason
+// wins, so a kick isn't reported as the read error it causes.
+func (c *Client) setCloseReason(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeReason == "" {
+		c.closeReason = reason
+	}
+}
+
+func (c *Client) getCloseReason() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeReason
+}
+
+// endPairing records the length of the pairing that just ended. Callers
+// clear Partner themselves.
+func (c *Client) endPairing() {
+	c.mu.Lock()
+	pairedAt := c.pairedAt
+	c.pairedAt = time.Time{}
+	c.mu.Unlock()
+	if !pairedAt.IsZero() {
+		metrics.CallDuration.Observe(time.Since(pairedAt).Seconds())
+	}
+}
+
+// kick closes the connection with a close frame explaining why. WriteControl
+// is safe to call alongside writePump.
+func (c *Client) kick(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	c.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	c.Conn.Close()
+}
+
+// sender identifies c to filters that track senders over time: the
+// account, else the device, else the IP.
+func (c *Client) sender() string {
+	if uid := c.Session.UserID(); uid != "" {
+		return "user:" + uid
+	}
+	if did := c.Session.DeviceID(); did != "" {
+		return "device:" + did
+	}
+	return "ip:" + c.IP
+}
+
+// identity is the key the matcher and bans use for this client: the account
+// user ID when logged in, otherwise the IP.
+func (c *Client) identity() string {
+	if uid := c.Session.UserID(); uid != "" {
+		return "user:" + uid
+	}
+	return "ip:" + c.IP
+}
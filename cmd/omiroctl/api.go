@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"omiro/redis"
+	"strings"
+	"time"
+)
+
+// apiBackend goes through a server's /admin API, for hosts that can reach
+// the servers but not Redis.
+type apiBackend struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+func newAPIBackend(base, token string) *apiBackend {
+	return &apiBackend{
+		base:   strings.TrimSuffix(base, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// do sends a request to the admin API and decodes the response into out,
+// if given. Error responses are returned as errors carrying the API's
+// message.
+func (a *apiBackend) do(ctx context.Context, method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, a.base+"/admin"+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Error == "" {
+			e.Error = resp.Status
+		}
+		return fmt.Errorf("%s %s: %s", method, path, e.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (a *apiBackend) Servers(ctx context.Context) ([]redis.ServerInfo, error) {
+	var resp struct {
+		Servers []redis.ServerInfo `json:"servers"`
+	}
+	err := a.do(ctx, http.MethodGet, "/servers", nil, &resp)
+	return resp.Servers, err
+}
+
+func (a *apiBackend) Clients(ctx context.Context, serverID string) ([]redis.ClientMeta, error) {
+	path := "/clients"
+	if serverID != "" {
+		path = "/servers/" + url.PathEscape(serverID) + "/clients"
+	}
+	var resp struct {
+		Clients []redis.ClientMeta `json:"clients"`
+	}
+	err := a.do(ctx, http.MethodGet, path, nil, &resp)
+	return resp.Clients, err
+}
+
+func (a *apiBackend) Kick(ctx context.Context, clientID, reason string) error {
+	return a.do(ctx, http.MethodPost, "/clients/"+url.PathEscape(clientID)+"/kick",
+		map[string]string{"reason": reason}, nil)
+}
+
+func (a *apiBackend) Bans(ctx context.Context) ([]redis.Ban, error) {
+	var resp struct {
+		Bans []redis.Ban `json:"bans"`
+	}
+	err := a.do(ctx, http.MethodGet, "/bans", nil, &resp)
+	return resp.Bans, err
+}
+
+func (a *apiBackend) Ban(ctx context.Context, kind, value string, duration time.Duration, reason string) error {
+	return a.do(ctx, http.MethodPost, "/bans", map[string]string{
+		"kind":     kind,
+		"value":    value,
+		"duration": duration.String(),
+		"reason":   reason,
+	}, nil)
+}
+
+func (a *apiBackend) Unban(ctx context.Context, kind, value string) error {
+	return a.do(ctx, http.MethodDelete, "/bans/"+url.PathEscape(kind)+"/"+url.PathEscape(value), nil, nil)
+}
+
+func (a *apiBackend) Reports(ctx context.Context, all bool) ([]redis.Report, error) {
+	path := "/reports"
+	if all {
+		path += "?all=1"
+	}
+	var resp struct {
+		Reports []redis.Report `json:"reports"`
+	}
+	err := a.do(ctx, http.MethodGet, path, nil, &resp)
+	return resp.Reports, err
+}
+
+func (a *apiBackend) ResolveReport(ctx context.Context, id string) error {
+	return a.do(ctx, http.MethodPost, "/reports/"+url.PathEscape(id)+"/resolve", nil, nil)
+}
+
+func (a *apiBackend) Broadcast(ctx context.Context, ann redis.Announcement) error {
+	return a.do(ctx, http.MethodPost, "/broadcast", ann, nil)
+}
+
+func (a *apiBackend) Maintenance(ctx context.Context) (*redis.Maintenance, error) {
+	var m redis.Maintenance
+	if err := a.do(ctx, http.MethodGet, "/maintenance", nil, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (a *apiBackend) SetMaintenance(ctx context.Context, enabled bool, message string) error {
+	return a.do(ctx, http.MethodPut, "/maintenance", map[string]any{
+		"enabled": enabled,
+		"message": message,
+	}, nil)
+}
+
+func (a *apiBackend) Stats(ctx context.Context) (*redis.Stats, error) {
+	var stats redis.Stats
+	if err := a.do(ctx, http.MethodGet, "/stats", nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
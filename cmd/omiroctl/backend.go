@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"omiro/middleware"
+	"omiro/redis"
+	"time"
+)
+
+// backend carries out commands either against Redis or the /admin API.
+type backend interface {
+	Servers(ctx context.Context) ([]redis.ServerInfo, error)
+	Clients(ctx context.Context, serverID string) ([]redis.ClientMeta, error)
+	Kick(ctx context.Context, clientID, reason string) error
+	Bans(ctx context.Context) ([]redis.Ban, error)
+	Ban(ctx context.Context, kind, value string, duration time.Duration, reason string) error
+	Unban(ctx context.Context, kind, value string) error
+	Reports(ctx context.Context, all bool) ([]redis.Report, error)
+	ResolveReport(ctx context.Context, id string) error
+	Broadcast(ctx context.Context, a redis.Announcement) error
+	Maintenance(ctx context.Context) (*redis.Maintenance, error)
+	SetMaintenance(ctx context.Context, enabled bool, message string) error
+	Stats(ctx context.Context) (*redis.Stats, error)
+}
+
+// redisBackend talks to Redis directly using the server's own redis
+// package, so it needs the same Redis settings as the servers.
+type redisBackend struct{}
+
+func (redisBackend) Servers(ctx context.Context) ([]redis.ServerInfo, error) {
+	return redis.ServerInfos(ctx)
+}
+
+func (redisBackend) Clients(ctx context.Context, serverID string) ([]redis.ClientMeta, error) {
+	if serverID != "" {
+		return redis.ServerClients(ctx, serverID)
+	}
+	return redis.AllClients(ctx)
+}
+
+func (redisBackend) Kick(ctx context.Context, clientID, reason string) error {
+	_, err := redis.KickClient(ctx, clientID, reason)
+	return notFound(err, "client "+clientID)
+}
+
+func (redisBackend) Bans(ctx context.Context) ([]redis.Ban, error) {
+	return redis.ListBans(ctx)
+}
+
+func (redisBackend) Ban(ctx context.Context, kind, value string, duration time.Duration, reason string) error {
+	return middleware.Ban(ctx, kind, value, duration, reason)
+}
+
+func (redisBackend) Unban(ctx context.Context, kind, value string) error {
+	ok, err := redis.Unban(ctx, kind, value)
+	if err == nil && !ok {
+		return errNotFound("ban " + kind + " " + value)
+	}
+	return err
+}
+
+func (redisBackend) Reports(ctx context.Context, all bool) ([]redis.Report, error) {
+	return redis.ListReports(ctx, all)
+}
+
+func (redisBackend) ResolveReport(ctx context.Context, id string) error {
+	ok, err := redis.ResolveReport(ctx, id)
+	if err == nil && !ok {
+		return errNotFound("report " + id)
+	}
+	return err
+}
+
+func (redisBackend) Broadcast(ctx context.Context, a redis.Announcement) error {
+	return redis.Announce(ctx, a)
+}
+
+func (redisBackend) Maintenance(ctx context.Context) (*redis.Maintenance, error) {
+	return redis.GetMaintenance(ctx)
+}
+
+func (redisBackend) SetMaintenance(ctx context.Context, enabled bool, message string) error {
+	return redis.SetMaintenance(ctx, enabled, message)
+}
+
+func (redisBackend) Stats(ctx context.Context) (*redis.Stats, error) {
+	return redis.ClusterStats(ctx)
+}
+
+type errNotFound string
+
+func (e errNotFound) Error() string { return string(e) + " not found" }
+
+// notFound turns a missing Redis key into errNotFound for what.
+func notFound(err error, what string) error {
+	if err != nil && err.Error() == "redis: nil" {
+		return errNotFound(what)
+	}
+	return err
+}
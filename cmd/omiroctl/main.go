@@ -0,0 +1,392 @@
+// Command omiroctl is the operator's tool for an Omiro cluster: bans,
+// connected clients, servers, moderation reports, announcements,
+// maintenance mode and stats.
+//
+// By default it talks to Redis directly, reading the Redis settings the
+// same way the server does (--config / OMIRO_CONFIG and REDIS_* variables).
+// With --api (or OMIROCTL_API) it goes through a server's /admin API
+// instead, authenticating with --token or ADMIN_TOKEN.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"omiro/config"
+	"omiro/logging"
+	"omiro/redis"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: omiroctl [flags] <command> [args]
+
+Commands:
+  servers list
+  clients list [--server ID]
+  clients kick [--reason TEXT] <client-id>
+  bans list
+  bans add [--duration 24h] [--reason TEXT] <ip|user|device> <value>
+  bans remove <ip|user|device> <value>
+  reports list [--all]
+  reports resolve <report-id>
+  broadcast [--severity info|warning|critical] [--expires 30m] "<message>"
+  maintenance on [--message TEXT] | off | status
+  stats
+
+Flags:
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "omiroctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("omiroctl", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	api := fs.String("api", os.Getenv("OMIROCTL_API"), "base URL of a server's admin API; talk to Redis directly when empty")
+	token := fs.String("token", "", "admin API token (default $ADMIN_TOKEN)")
+	configPath := fs.String("config", "", "server config file for the Redis settings (default $OMIRO_CONFIG)")
+	asJSON := fs.Bool("json", false, "print JSON instead of tables")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no command given")
+	}
+
+	b, err := connect(*api, *token, *configPath)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	p := printer{w: out, json: *asJSON}
+	cmd, rest := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "servers":
+		return serversCmd(ctx, b, p, rest)
+	case "clients":
+		return clientsCmd(ctx, b, p, rest)
+	case "bans":
+		return bansCmd(ctx, b, p, rest)
+	case "reports":
+		return reportsCmd(ctx, b, p, rest)
+	case "broadcast":
+		return broadcastCmd(ctx, b, p, rest)
+	case "maintenance":
+		return maintenanceCmd(ctx, b, p, rest)
+	case "stats":
+		return statsCmd(ctx, b, p)
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+// connect picks the backend: the admin API when a URL is given, otherwise
+// Redis configured like the servers.
+func connect(api, token, configPath string) (backend, error) {
+	var loadArgs []string
+	if configPath != "" {
+		loadArgs = append(loadArgs, "--config", configPath)
+	}
+	cfg, _, err := config.Load(loadArgs)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+
+	if api != "" {
+		if token == "" {
+			token = cfg.Admin.Token
+		}
+		if token == "" {
+			return nil, errors.New("--api needs --token or ADMIN_TOKEN")
+		}
+		return newAPIBackend(api, token), nil
+	}
+
+	// keep the redis package's info logs out of the command output
+	logging.Setup(os.Stderr, logging.Options{Level: "warn"})
+	if err := redis.Init(redis.Config{
+		Host:     cfg.Redis.Host,
+		Port:     strconv.Itoa(cfg.Redis.Port),
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
+	}); err != nil {
+		return nil, err
+	}
+	return redisBackend{}, nil
+}
+
+func serversCmd(ctx context.Context, b backend, p printer, args []string) error {
+	if len(args) != 1 || args[0] != "list" {
+		return errors.New("usage: servers list")
+	}
+	servers, err := b.Servers(ctx)
+	if err != nil {
+		return err
+	}
+	return p.table(servers, []string{"ID", "HEARTBEAT AGE", "CLIENTS"}, func(row func(...any)) {
+		for _, s := range servers {
+			row(s.ID, time.Since(time.Unix(s.LastHeartbeat, 0)).Round(time.Second), s.Clients)
+		}
+	})
+}
+
+func clientsCmd(ctx context.Context, b backend, p printer, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: clients list|kick")
+	}
+	switch args[0] {
+	case "list":
+		fs := flag.NewFlagSet("clients list", flag.ContinueOnError)
+		server := fs.String("server", "", "only list clients of this server")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		clients, err := b.Clients(ctx, *server)
+		if err != nil {
+			return err
+		}
+		return p.table(clients, []string{"ID", "SERVER", "IP", "DEVICE", "MODE", "STATE", "PARTNER", "CONNECTED"}, func(row func(...any)) {
+			for _, c := range clients {
+				state := "idle"
+				switch {
+				case c.PartnerID != "":
+					state = "paired"
+				case c.InQueue:
+					state = "queued"
+				}
+				row(c.ID, c.ServerID, c.IP, c.DeviceID, c.Mode, state, c.PartnerID, formatTime(c.ConnectedAt))
+			}
+		})
+
+	case "kick":
+		fs := flag.NewFlagSet("clients kick", flag.ContinueOnError)
+		reason := fs.String("reason", "", "reason shown to the client")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return errors.New("usage: clients kick [--reason TEXT] <client-id>")
+		}
+		if err := b.Kick(ctx, fs.Arg(0), *reason); err != nil {
+			return err
+		}
+		return p.done("kick sent to " + fs.Arg(0))
+	}
+	return fmt.Errorf("unknown clients command %q", args[0])
+}
+
+func bansCmd(ctx context.Context, b backend, p printer, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: bans list|add|remove")
+	}
+	switch args[0] {
+	case "list":
+		bans, err := b.Bans(ctx)
+		if err != nil {
+			return err
+		}
+		return p.table(bans, []string{"KIND", "VALUE", "REASON", "EXPIRES"}, func(row func(...any)) {
+			for _, ban := range bans {
+				expires := "never"
+				if ban.ExpiresAt > 0 {
+					expires = formatTime(ban.ExpiresAt)
+				}
+				row(ban.Kind, ban.Value, ban.Reason, expires)
+			}
+		})
+
+	case "add":
+		fs := flag.NewFlagSet("bans add", flag.ContinueOnError)
+		duration := fs.Duration("duration", 24*time.Hour, "how long the ban lasts; 0 never expires")
+		reason := fs.String("reason", "", "reason stored with the ban")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 2 || !validKind(fs.Arg(0)) {
+			return errors.New("usage: bans add [--duration 24h] [--reason TEXT] <ip|user|device> <value>")
+		}
+		if err := b.Ban(ctx, fs.Arg(0), fs.Arg(1), *duration, *reason); err != nil {
+			return err
+		}
+		return p.done(fmt.Sprintf("banned %s %s", fs.Arg(0), fs.Arg(1)))
+
+	case "remove":
+		if len(args) != 3 || !validKind(args[1]) {
+			return errors.New("usage: bans remove <ip|user|device> <value>")
+		}
+		if err := b.Unban(ctx, args[1], args[2]); err != nil {
+			return err
+		}
+		return p.done(fmt.Sprintf("unbanned %s %s", args[1], args[2]))
+	}
+	return fmt.Errorf("unknown bans command %q", args[0])
+}
+
+func reportsCmd(ctx context.Context, b backend, p printer, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: reports list|resolve")
+	}
+	switch args[0] {
+	case "list":
+		fs := flag.NewFlagSet("reports list", flag.ContinueOnError)
+		all := fs.Bool("all", false, "include resolved reports")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		reports, err := b.Reports(ctx, *all)
+		if err != nil {
+			return err
+		}
+		return p.table(reports, []string{"ID", "CREATED", "CLIENT", "DEVICE", "REASON", "RESOLVED"}, func(row func(...any)) {
+			for _, r := range reports {
+				row(r.ID, formatTime(r.CreatedAt), r.ClientID, r.DeviceID, r.Reason, r.Resolved)
+			}
+		})
+
+	case "resolve":
+		if len(args) != 2 {
+			return errors.New("usage: reports resolve <report-id>")
+		}
+		if err := b.ResolveReport(ctx, args[1]); err != nil {
+			return err
+		}
+		return p.done("resolved " + args[1])
+	}
+	return fmt.Errorf("unknown reports command %q", args[0])
+}
+
+func broadcastCmd(ctx context.Context, b backend, p printer, args []string) error {
+	fs := flag.NewFlagSet("broadcast", flag.ContinueOnError)
+	severity := fs.String("severity", "info", "info, warning or critical")
+	expires := fs.Duration("expires", 0, "keep showing it, also to clients that connect later, for this long")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || strings.TrimSpace(fs.Arg(0)) == "" {
+		return errors.New(`usage: broadcast [--severity info|warning|critical] [--expires 30m] "<message>"`)
+	}
+
+	a := redis.Announcement{Message: fs.Arg(0), Severity: *severity}
+	if *expires > 0 {
+		a.ExpiresAt = time.Now().Add(*expires).Unix()
+	}
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	if err := b.Broadcast(ctx, a); err != nil {
+		return err
+	}
+	return p.done("announcement sent")
+}
+
+func maintenanceCmd(ctx context.Context, b backend, p printer, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: maintenance on|off|status")
+	}
+	switch args[0] {
+	case "on":
+		fs := flag.NewFlagSet("maintenance on", flag.ContinueOnError)
+		message := fs.String("message", "", "shown to clients that are turned away")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if err := b.SetMaintenance(ctx, true, *message); err != nil {
+			return err
+		}
+		return p.done("maintenance mode on")
+
+	case "off":
+		if err := b.SetMaintenance(ctx, false, ""); err != nil {
+			return err
+		}
+		return p.done("maintenance mode off")
+
+	case "status":
+		m, err := b.Maintenance(ctx)
+		if err != nil {
+			return err
+		}
+		return p.table(m, []string{"ENABLED", "SINCE", "MESSAGE"}, func(row func(...any)) {
+			row(m.Enabled, formatTime(m.Since), m.Message)
+		})
+	}
+	return fmt.Errorf("unknown maintenance command %q", args[0])
+}
+
+func statsCmd(ctx context.Context, b backend, p printer) error {
+	s, err := b.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	return p.table(s, []string{"SERVERS", "CLIENTS", "QUEUED", "PAIRS", "OPEN REPORTS", "BANS", "MAINTENANCE"}, func(row func(...any)) {
+		row(s.Servers, s.Clients, s.Queued, s.Pairs, s.OpenReports, s.Bans, s.Maintenance)
+	})
+}
+
+func validKind(kind string) bool {
+	return kind == "ip" || kind == "user" || kind == "device"
+}
+
+func formatTime(unix int64) string {
+	if unix == 0 {
+		return "-"
+	}
+	return time.Unix(unix, 0).Format(time.DateTime)
+}
+
+// printer writes results as aligned tables, or as JSON for scripts.
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+// table prints v as JSON, or calls rows to fill a table under header.
+func (p printer) table(v any, header []string, rows func(row func(...any))) error {
+	if p.json {
+		enc := json.NewEncoder(p.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	rows(func(cols ...any) {
+		s := make([]string, len(cols))
+		for i, c := range cols {
+			s[i] = fmt.Sprint(c)
+			if s[i] == "" {
+				s[i] = "-"
+			}
+		}
+		fmt.Fprintln(tw, strings.Join(s, "\t"))
+	})
+	return tw.Flush()
+}
+
+// done reports a completed action.
+func (p printer) done(msg string) error {
+	if p.json {
+		return json.NewEncoder(p.w).Encode(map[string]string{"status": msg})
+	}
+	_, err := fmt.Fprintln(p.w, msg)
+	return err
+}
@@ -0,0 +1,326 @@
+// Package config loads Omiro's settings from defaults, an optional YAML file,
+// environment variables and command line flags, in that order of precedence.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Log       LogConfig       `yaml:"log"`
+	Redis     RedisConfig     `yaml:"redis"`
+	WebSocket WebSocketConfig `yaml:"websocket"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Proxy     ProxyConfig     `yaml:"proxy"`
+	Origins   OriginsConfig   `yaml:"origins"`
+	Session   SessionConfig   `yaml:"session"`
+	Challenge ChallengeConfig `yaml:"challenge"`
+	Chat      ChatConfig      `yaml:"chat"`
+	Match     MatchConfig     `yaml:"match"`
+	Media     MediaConfig     `yaml:"media"`
+	OIDC      OIDCConfig      `yaml:"oidc"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+	Admin     AdminConfig     `yaml:"admin"`
+	Cluster   ClusterConfig   `yaml:"cluster"`
+
+	// Path is the file the config was read from, if any.
+	Path string `yaml:"-"`
+}
+
+type ServerConfig struct {
+	Port int `yaml:"port" env:"PORT"`
+	// DrainPeriod is how long clients get to move to another server after
+	// SIGTERM before the remaining connections are closed.
+	DrainPeriod     time.Duration `yaml:"drain_period" env:"SHUTDOWN_DRAIN_PERIOD"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL"`
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+	// ShowIPs logs raw client IPs, but only at debug level. Otherwise they
+	// are hashed with IPSalt.
+	ShowIPs bool   `yaml:"show_ips" env:"LOG_SHOW_IPS"`
+	IPSalt  string `yaml:"ip_salt" env:"LOG_IP_SALT" secret:"true"`
+}
+
+type RedisConfig struct {
+	Host     string `yaml:"host" env:"REDIS_HOST"`
+	Port     int    `yaml:"port" env:"REDIS_PORT"`
+	Password string `yaml:"password" env:"REDIS_PASSWORD,REDIS_PASS" secret:"true"`
+	DB       int    `yaml:"db" env:"REDIS_DB"`
+	// ClientTTL bounds how long a client's metadata outlives its server.
+	ClientTTL time.Duration `yaml:"client_ttl" env:"REDIS_CLIENT_TTL"`
+	// ServerTTL is how long a server stays listed without a heartbeat.
+	ServerTTL time.Duration `yaml:"server_ttl" env:"REDIS_SERVER_TTL"`
+}
+
+type WebSocketConfig struct {
+	ReadBufferSize   int           `yaml:"read_buffer_size" env:"WS_READ_BUFFER_SIZE"`
+	WriteBufferSize  int           `yaml:"write_buffer_size" env:"WS_WRITE_BUFFER_SIZE"`
+	SendQueueSize    int           `yaml:"send_queue_size" env:"WS_SEND_QUEUE_SIZE"`
+	HandshakeTimeout time.Duration `yaml:"handshake_timeout" env:"WS_HANDSHAKE_TIMEOUT"`
+	PingInterval     time.Duration `yaml:"ping_interval" env:"WS_PING_INTERVAL"`
+	PongTimeout      time.Duration `yaml:"pong_timeout" env:"WS_PONG_TIMEOUT"`
+	Compression      bool          `yaml:"compression" env:"WS_COMPRESSION"`
+}
+
+// RateLimitConfig limits are per client IP per minute.
+type RateLimitConfig struct {
+	Handshake int `yaml:"handshake" env:"RATE_LIMIT_HANDSHAKE"`
+	Upload    int `yaml:"upload" env:"RATE_LIMIT_UPLOAD"`
+}
+
+type ProxyConfig struct {
+	Trusted         []string `yaml:"trusted" env:"TRUSTED_PROXIES"`
+	TrustCloudflare bool     `yaml:"trust_cloudflare" env:"TRUSTED_CLOUDFLARE"`
+}
+
+type OriginsConfig struct {
+	Allowed        []string `yaml:"allowed" env:"ALLOWED_ORIGINS"`
+	AllowLocalhost bool     `yaml:"allow_localhost" env:"ORIGIN_ALLOW_LOCALHOST"`
+}
+
+type SessionConfig struct {
+	KeysFile      string        `yaml:"keys_file" env:"SESSION_KEYS_FILE"`
+	Keys          string        `yaml:"keys" env:"SESSION_KEYS" secret:"true"`
+	CurrentKey    string        `yaml:"current_key" env:"SESSION_KEY_CURRENT"`
+	DeviceKey     string        `yaml:"device_key" env:"DEVICE_KEY" secret:"true"`
+	TokenTTL      time.Duration `yaml:"token_ttl" env:"SESSION_TOKEN_TTL"`
+	SingleUse     bool          `yaml:"single_use" env:"SESSION_SINGLE_USE"`
+	BindIP        bool          `yaml:"bind_ip" env:"SESSION_BIND_IP"`
+	IPv4Prefix    int           `yaml:"bind_ipv4_prefix" env:"SESSION_BIND_IPV4_PREFIX"`
+	IPv6Prefix    int           `yaml:"bind_ipv6_prefix" env:"SESSION_BIND_IPV6_PREFIX"`
+	BindUserAgent bool          `yaml:"bind_user_agent" env:"SESSION_BIND_USER_AGENT"`
+}
+
+type ChallengeConfig struct {
+	// Type is one of none, pow, captcha or fake-captcha.
+	Type                string `yaml:"type" env:"SESSION_CHALLENGE"`
+	PowDifficulty       int    `yaml:"pow_difficulty" env:"POW_DIFFICULTY"`
+	PowMaxDifficulty    int    `yaml:"pow_max_difficulty" env:"POW_MAX_DIFFICULTY"`
+	PowPressureStep     int    `yaml:"pow_pressure_step" env:"POW_PRESSURE_STEP"`
+	CaptchaProvider     string `yaml:"captcha_provider" env:"CAPTCHA_PROVIDER"`
+	CaptchaSiteKey      string `yaml:"captcha_site_key" env:"CAPTCHA_SITE_KEY"`
+	CaptchaVerifyURL    string `yaml:"captcha_verify_url" env:"CAPTCHA_VERIFY_URL"`
+	CaptchaSecret       string `yaml:"captcha_secret" env:"CAPTCHA_SECRET" secret:"true"`
+	CaptchaFakeResponse string `yaml:"captcha_fake_response" env:"CAPTCHA_FAKE_RESPONSE"`
+}
+
+type ChatConfig struct {
+	Filters         []string      `yaml:"filters" env:"CHAT_FILTERS"`
+	ProfanityFile   string        `yaml:"profanity_file" env:"CHAT_PROFANITY_FILE"`
+	ProfanityAction string        `yaml:"profanity_action" env:"CHAT_PROFANITY_ACTION"`
+	LinkAllowlist   []string      `yaml:"link_allowlist" env:"CHAT_LINK_ALLOWLIST"`
+	LinkAction      string        `yaml:"link_action" env:"CHAT_LINK_ACTION"`
+	PII             []string      `yaml:"pii" env:"CHAT_PII"`
+	SpamPartners    int           `yaml:"spam_partners" env:"CHAT_SPAM_PARTNERS"`
+	SpamWindow      time.Duration `yaml:"spam_window" env:"CHAT_SPAM_WINDOW"`
+	SpamAction      string        `yaml:"spam_action" env:"CHAT_SPAM_ACTION"`
+}
+
+type MatchConfig struct {
+	BlockSameIP bool `yaml:"block_same_ip" env:"MATCH_BLOCK_SAME_IP"`
+}
+
+type MediaConfig struct {
+	Store    string        `yaml:"store" env:"MEDIA_STORE"`
+	MaxBytes int64         `yaml:"max_bytes" env:"MEDIA_MAX_BYTES"`
+	TTL      time.Duration `yaml:"ttl" env:"MEDIA_TTL"`
+	Secret   string        `yaml:"secret" env:"MEDIA_SECRET" secret:"true"`
+	Dir      string        `yaml:"dir" env:"MEDIA_DIR"`
+	BaseURL  string        `yaml:"base_url" env:"MEDIA_BASE_URL"`
+	S3       S3Config      `yaml:"s3"`
+}
+
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint" env:"MEDIA_S3_ENDPOINT"`
+	Region    string `yaml:"region" env:"MEDIA_S3_REGION"`
+	Bucket    string `yaml:"bucket" env:"MEDIA_S3_BUCKET"`
+	AccessKey string `yaml:"access_key" env:"MEDIA_S3_ACCESS_KEY"`
+	SecretKey string `yaml:"secret_key" env:"MEDIA_S3_SECRET_KEY" secret:"true"`
+	PathStyle bool   `yaml:"path_style" env:"MEDIA_S3_PATH_STYLE"`
+}
+
+type OIDCConfig struct {
+	Issuer       string   `yaml:"issuer" env:"OIDC_ISSUER"`
+	ClientID     string   `yaml:"client_id" env:"OIDC_CLIENT_ID"`
+	ClientSecret string   `yaml:"client_secret" env:"OIDC_CLIENT_SECRET" secret:"true"`
+	RedirectURL  string   `yaml:"redirect_url" env:"OIDC_REDIRECT_URL"`
+	Scopes       []string `yaml:"scopes" env:"OIDC_SCOPES"`
+	Mock         bool     `yaml:"mock" env:"OIDC_MOCK"`
+	MockIssuer   string   `yaml:"mock_issuer" env:"OIDC_MOCK_ISSUER"`
+}
+
+type TracingConfig struct {
+	// Exporter is none, otlp or stdout.
+	Exporter string `yaml:"exporter" env:"TRACING_EXPORTER"`
+	// OTLPEndpoint is the collector's OTLP/HTTP URL. Empty uses the standard
+	// OTEL_EXPORTER_OTLP_ENDPOINT variable.
+	OTLPEndpoint string `yaml:"otlp_endpoint" env:"TRACING_OTLP_ENDPOINT"`
+	// SampleRatio is the share of new traces recorded, from 0 to 1.
+	SampleRatio float64 `yaml:"sample_ratio" env:"TRACING_SAMPLE_RATIO"`
+	ServiceName string  `yaml:"service_name" env:"TRACING_SERVICE_NAME,OTEL_SERVICE_NAME"`
+}
+
+type AdminConfig struct {
+	// Token is the bearer token for the /admin API, which is off when it is
+	// empty.
+	Token string `yaml:"token" env:"ADMIN_TOKEN" secret:"true"`
+}
+
+type ClusterConfig struct {
+	// LeaseTTL is how long the leader's lease lasts without a renewal, and
+	// so roughly how long singleton jobs pause when the leader dies.
+	LeaseTTL time.Duration `yaml:"lease_ttl" env:"CLUSTER_LEASE_TTL"`
+	// ReapInterval is how often the leader looks for servers whose
+	// heartbeat has expired and cleans up after them.
+	ReapInterval time.Duration `yaml:"reap_interval" env:"CLUSTER_REAP_INTERVAL"`
+}
+
+// Default returns the settings used when nothing else is configured.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:            8080,
+			DrainPeriod:     15 * time.Second,
+			ShutdownTimeout: 10 * time.Second,
+		},
+		Log: LogConfig{Level: "info", Format: "text"},
+		Redis: RedisConfig{
+			Host:      "localhost",
+			Port:      6379,
+			ClientTTL: 2 * time.Hour,
+			ServerTTL: 60 * time.Second,
+		},
+		WebSocket: WebSocketConfig{
+			ReadBufferSize:   1024,
+			WriteBufferSize:  1024,
+			SendQueueSize:    256,
+			HandshakeTimeout: 10 * time.Second,
+			PingInterval:     30 * time.Second,
+			PongTimeout:      60 * time.Second,
+			Compression:      true,
+		},
+		RateLimit: RateLimitConfig{Handshake: 60, Upload: 10},
+		Proxy:     ProxyConfig{Trusted: []string{"127.0.0.0/8", "::1/128"}},
+		Session: SessionConfig{
+			TokenTTL:   10 * time.Minute,
+			IPv4Prefix: 32,
+			IPv6Prefix: 64,
+		},
+		Challenge: ChallengeConfig{
+			Type:                "none",
+			PowDifficulty:       18,
+			PowMaxDifficulty:    24,
+			PowPressureStep:     20,
+			CaptchaFakeResponse: "pass",
+		},
+		Chat: ChatConfig{
+			PII:          []string{"phone", "email"},
+			SpamPartners: 3,
+			SpamWindow:   10 * time.Minute,
+		},
+		Media: MediaConfig{
+			Store:    "local",
+			MaxBytes: 5 << 20,
+			TTL:      10 * time.Minute,
+			S3: S3Config{
+				Endpoint: "https://s3.amazonaws.com",
+				Region:   "us-east-1",
+			},
+		},
+		OIDC: OIDCConfig{
+			ClientID:    "omiro",
+			RedirectURL: "http://localhost:8080/auth/callback",
+			Scopes:      []string{"openid", "email"},
+			MockIssuer:  "http://localhost:8080/mock-idp",
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			SampleRatio: 1,
+			ServiceName: "omiro",
+		},
+		Cluster: ClusterConfig{
+			LeaseTTL:     15 * time.Second,
+			ReapInterval: 30 * time.Second,
+		},
+	}
+}
+
+// Validate reports every problem it finds, not just the first.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server.port %d out of range", c.Server.Port)
+	check(c.Server.DrainPeriod >= 0, "server.drain_period can't be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("unknown log.level %q", c.Log.Level))
+	}
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log.format must be text or json")
+	check(c.Redis.Host != "", "redis.host is required")
+	check(c.Redis.Port > 0 && c.Redis.Port < 65536, "redis.port %d out of range", c.Redis.Port)
+	check(c.Redis.ClientTTL > 0, "redis.client_ttl must be positive")
+	check(c.Redis.ServerTTL >= 10*time.Second, "redis.server_ttl must be at least 10s")
+
+	check(c.WebSocket.ReadBufferSize > 0, "websocket.read_buffer_size must be positive")
+	check(c.WebSocket.WriteBufferSize > 0, "websocket.write_buffer_size must be positive")
+	check(c.WebSocket.SendQueueSize > 0, "websocket.send_queue_size must be positive")
+	check(c.WebSocket.HandshakeTimeout > 0, "websocket.handshake_timeout must be positive")
+	check(c.WebSocket.PingInterval > 0, "websocket.ping_interval must be positive")
+	check(c.WebSocket.PongTimeout > c.WebSocket.PingInterval, "websocket.pong_timeout must be longer than ping_interval")
+
+	check(c.RateLimit.Handshake > 0, "rate_limit.handshake must be positive")
+	check(c.RateLimit.Upload > 0, "rate_limit.upload must be positive")
+
+	check(c.Session.TokenTTL > 0 && c.Session.TokenTTL <= 24*time.Hour, "session.token_ttl must be positive and at most 24h")
+	check(c.Session.DeviceKey == "" || len(c.Session.DeviceKey) >= 32, "session.device_key must be at least 32 characters")
+	check(c.Session.IPv4Prefix > 0 && c.Session.IPv4Prefix <= 32, "session.bind_ipv4_prefix must be 1-32")
+	check(c.Session.IPv6Prefix > 0 && c.Session.IPv6Prefix <= 128, "session.bind_ipv6_prefix must be 1-128")
+
+	switch c.Challenge.Type {
+	case "none", "fake-captcha":
+	case "pow":
+		check(c.Challenge.PowDifficulty > 0 && c.Challenge.PowDifficulty <= c.Challenge.PowMaxDifficulty,
+			"challenge.pow_difficulty must be between 1 and pow_max_difficulty")
+		check(c.Challenge.PowMaxDifficulty <= 32, "challenge.pow_max_difficulty must be at most 32")
+	case "captcha":
+		check(c.Challenge.CaptchaVerifyURL != "", "challenge.captcha_verify_url is required for captcha")
+	default:
+		errs = append(errs, fmt.Errorf("unknown challenge.type %q", c.Challenge.Type))
+	}
+
+	check(c.Media.MaxBytes > 0, "media.max_bytes must be positive")
+	check(c.Media.TTL > 0, "media.ttl must be positive")
+	switch c.Media.Store {
+	case "local":
+	case "s3":
+		check(c.Media.S3.Bucket != "", "media.s3.bucket is required for the s3 store")
+	default:
+		errs = append(errs, fmt.Errorf("unknown media.store %q", c.Media.Store))
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		errs = append(errs, fmt.Errorf("unknown tracing.exporter %q", c.Tracing.Exporter))
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+	check(c.Tracing.ServiceName != "", "tracing.service_name is required")
+	check(c.Admin.Token == "" || len(c.Admin.Token) >= 16, "admin.token must be at least 16 characters")
+	check(c.Cluster.LeaseTTL >= 3*time.Second, "cluster.lease_ttl must be at least 3s")
+	check(c.Cluster.ReapInterval > 0, "cluster.reap_interval must be positive")
+
+	return errors.Join(errs...)
+}
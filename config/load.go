@@ -0,0 +1,206 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Load builds the config from defaults, the YAML file named by --config or
+// OMIRO_CONFIG, environment variables and finally command line flags. Every
+// setting has a flag named after its YAML path, e.g. --redis.host.
+//
+// printOnly is set when --print-config was passed.
+func Load(args []string) (cfg *Config, printOnly bool, err error) {
+	cfg = Default()
+
+	fs := flag.NewFlagSet("omiro", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("OMIRO_CONFIG"), "path to a YAML config file")
+	printConfig := fs.Bool("print-config", false, "print the effective config (secrets redacted) and exit")
+
+	overrides := map[string]string{}
+	walk(reflect.ValueOf(cfg).Elem(), "", func(f field) {
+		name := f.path
+		usage := ""
+		if len(f.env) > 0 {
+			usage = "overrides $" + f.env[0]
+		}
+		fs.Func(name, usage, func(s string) error {
+			overrides[name] = s
+			return nil
+		})
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	if *path != "" {
+		raw, err := os.ReadFile(*path)
+		if err != nil {
+			return nil, false, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(raw))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, false, fmt.Errorf("%s: %w", *path, err)
+		}
+		cfg.Path = *path
+	}
+
+	var errs []error
+	walk(reflect.ValueOf(cfg).Elem(), "", func(f field) {
+		for _, key := range f.env {
+			if raw, ok := os.LookupEnv(key); ok && raw != "" {
+				if err := set(f.value, raw); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", key, err))
+				}
+				break
+			}
+		}
+		if raw, ok := overrides[f.path]; ok {
+			if err := set(f.value, raw); err != nil {
+				errs = append(errs, fmt.Errorf("--%s: %w", f.path, err))
+			}
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, false, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, false, err
+	}
+	return cfg, *printConfig, nil
+}
+
+// Write dumps c as YAML with secrets replaced, for --print-config.
+func (c *Config) Write(w io.Writer) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	walk(reflect.ValueOf(c).Elem(), "", func(f field) {
+		parent := root
+		keys := strings.Split(f.path, ".")
+		for _, key := range keys[:len(keys)-1] {
+			parent = child(parent, key)
+		}
+
+		var value yaml.Node
+		switch {
+		case f.secret && f.value.String() != "":
+			value.SetString("REDACTED")
+		case f.value.Type() == durationType:
+			value.SetString(time.Duration(f.value.Int()).String())
+		default:
+			value.Encode(f.value.Interface())
+		}
+		parent.Content = append(parent.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: keys[len(keys)-1]}, &value)
+	})
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	defer enc.Close()
+	return enc.Encode(root)
+}
+
+// child returns the mapping under key in parent, adding it if needed.
+func child(parent *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(parent.Content); i += 2 {
+		if parent.Content[i].Value == key {
+			return parent.Content[i+1]
+		}
+	}
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, node)
+	return node
+}
+
+// field is one leaf setting found while walking the config struct.
+type field struct {
+	path   string
+	env    []string
+	secret bool
+	value  reflect.Value
+}
+
+func walk(v reflect.Value, prefix string, fn func(field)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, _, _ := strings.Cut(sf.Tag.Get("yaml"), ",")
+		if name == "-" || name == "" {
+			continue
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		fv := v.Field(i)
+		if sf.Type.Kind() == reflect.Struct {
+			walk(fv, name, fn)
+			continue
+		}
+
+		f := field{path: name, secret: sf.Tag.Get("secret") == "true", value: fv}
+		if env := sf.Tag.Get("env"); env != "" {
+			f.env = strings.Split(env, ",")
+		}
+		fn(f)
+	}
+}
+
+// set parses raw into v. Lists are comma-separated.
+func set(v reflect.Value, raw string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Action int
+
+const (
+	Allow Action = iota
+	Redact
+	Flag
+	Block
+)
+
+func (a Action) String() string {
+	switch a {
+	case Redact:
+		return "redact"
+	case Flag:
+		return "flag"
+	case Block:
+		return "block"
+	default:
+		return "allow"
+	}
+}
+
+func ParseAction(s string) (Action, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "allow":
+		return Allow, nil
+	case "redact":
+		return Redact, nil
+	case "flag":
+		return Flag, nil
+	case "block":
+		return Block, nil
+	}
+	return Allow, fmt.Errorf("unknown filter action %q", s)
+}
+
+// Message is a single chat line on its way from SenderID to PartnerID.
+// Sender identifies who sent it across reconnects and servers (account,
+// device or IP); filters that track senders over time key on it.
+type Message struct {
+	SenderID  string
+	Sender    string
+	PartnerID string
+	Text      string
+}
+
+type Result struct {
+	Action Action
+	Text   string
+	Filter string
+	Reason string
+}
+
+type ChatFilter interface {
+	Name() string
+	Check(msg Message) Result
+}
+
+// Pipeline runs filters in order. Redactions are carried into the next
+// filter, a block stops the pipeline, and the strongest action wins.
+type Pipeline []ChatFilter
+
+func (p Pipeline) Run(msg Message) Result {
+	final := Result{Action: Allow, Text: msg.Text}
+
+	for _, f := range p {
+		msg.Text = final.Text
+		res := f.Check(msg)
+
+		if res.Action == Redact || res.Action == Flag {
+			if res.Text != "" {
+				final.Text = res.Text
+			}
+		}
+
+		if res.Action > final.Action {
+			final.Action = res.Action
+			final.Filter = f.Name()
+			final.Reason = res.Reason
+		}
+
+		if res.Action == Block {
+			break
+		}
+	}
+
+	return final
+}
+
+/********************************
+ * CONFIG
+ ********************************/
+
+type Config struct {
+	Enabled []string
+
+	ProfanityWords  []string
+	ProfanityAction Action
+
+	LinkAllowlist []string
+	LinkAction    Action
+
+	RedactPhones bool
+	RedactEmails bool
+
+	SpamPartners int
+	SpamWindow   time.Duration
+	SpamAction   Action
+}
+
+func New(cfg Config) (Pipeline, error) {
+	var p Pipeline
+
+	for _, name := range cfg.Enabled {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "":
+			continue
+		case "profanity":
+			p = append(p, NewProfanity(cfg.ProfanityWords, cfg.ProfanityAction))
+		case "links":
+			p = append(p, NewLinks(cfg.LinkAllowlist, cfg.LinkAction))
+		case "pii":
+			p = append(p, NewPII(cfg.RedactPhones, cfg.RedactEmails))
+		case "spam":
+			p = append(p, NewSpam(cfg.SpamPartners, cfg.SpamWindow, cfg.SpamAction))
+		default:
+			return nil, fmt.Errorf("unknown chat filter %q", name)
+		}
+	}
+
+	return p, nil
+}
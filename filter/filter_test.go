@@ -0,0 +1,191 @@
+package filter
+
+import (
+	"omiro/redis"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestProfanity(t *testing.T) {
+	p := NewProfanity(nil, Redact)
+
+	tests := []struct {
+		text   string
+		action Action
+		want   string
+	}{
+		{"hello there", Allow, ""},
+		{"shit", Redact, "****"},
+		{"shit.", Redact, "****."},
+		{"shit!", Redact, "****!"},
+		{"you bitch!!", Redact, "you *****!!"},
+		{"(shit)", Redact, "(****)"},
+		{"what the fuck?!", Redact, "what the ****?!"},
+		{"$hit", Redact, "****"},
+		{"sh!t", Redact, "****"},
+		{"5h1t", Redact, "****"},
+		{"F.u.u.u.c.k", Redact, "***********"},
+		{"fuuuuck", Redact, "*******"},
+		{"@sshole!", Redact, "*******!"},
+		{"this is fine!", Allow, ""},
+		{"hi!!", Allow, ""},
+		{"shitake", Allow, ""},
+		{"dickens", Allow, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			res := p.Check(Message{Text: tt.text})
+			if res.Action != tt.action {
+				t.Fatalf("action = %v, want %v", res.Action, tt.action)
+			}
+			if res.Text != tt.want {
+				t.Fatalf("text = %q, want %q", res.Text, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinks(t *testing.T) {
+	l := NewLinks([]string{"*.example.org"}, Block)
+
+	tests := []struct {
+		text   string
+		action Action
+		want   string
+	}{
+		{"no links here", Allow, ""},
+		{"see https://evil.com/x", Block, "see [link removed]"},
+		{"go to www.spam.net now", Block, "go to [link removed] now"},
+		{"bit.ly/abc", Block, "[link removed]"},
+		{"docs at https://docs.example.org/a", Allow, ""},
+		{"example.org", Allow, ""},
+		{"mail me at me@evil.com", Allow, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			res := l.Check(Message{Text: tt.text})
+			if res.Action != tt.action || res.Text != tt.want {
+				t.Fatalf("Check() = %v %q, want %v %q", res.Action, res.Text, tt.action, tt.want)
+			}
+		})
+	}
+}
+
+func TestPII(t *testing.T) {
+	p := NewPII(true, true)
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"meet at 5", "meet at 5"},
+		{"mail me@example.com", "mail [email removed]"},
+		{"call +1 555 123 4567", "call [phone removed]"},
+		{"call 0151-2345678", "call [phone removed]"},
+		{"room 12345", "room 12345"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			res := p.Check(Message{Text: tt.text})
+			got := tt.text
+			if res.Action == Redact {
+				got = res.Text
+			}
+			if got != tt.want {
+				t.Fatalf("text = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	p, err := New(Config{
+		Enabled:         []string{"profanity", "pii", "links"},
+		ProfanityAction: Redact,
+		RedactEmails:    true,
+		LinkAction:      Block,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		text   string
+		action Action
+		filter string
+		want   string
+	}{
+		{"clean", "hi there", Allow, "", "hi there"},
+		{"redactions combine", "shit, mail a@b.co", Redact, "profanity", "****, mail [email removed]"},
+		// a blocked message is never delivered, so its text isn't redacted further
+		{"block wins", "shit https://evil.com", Block, "links", "**** https://evil.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := p.Run(Message{Text: tt.text})
+			if res.Action != tt.action || res.Filter != tt.filter || res.Text != tt.want {
+				t.Fatalf("Run() = %v %q %q, want %v %q %q", res.Action, res.Filter, res.Text, tt.action, tt.filter, tt.want)
+			}
+		})
+	}
+
+	if _, err := New(Config{Enabled: []string{"nope"}}); err == nil {
+		t.Fatal("unknown filter accepted")
+	}
+}
+
+func TestSpam(t *testing.T) {
+	m := miniredis.RunT(t)
+	if err := redis.Init(redis.Config{Host: m.Host(), Port: m.Port()}); err != nil {
+		t.Fatal(err)
+	}
+	s := NewSpam(3, time.Minute, Flag)
+	const ad = "visit my site for free stuff"
+
+	send := func(conn, sender, partner, text string) Action {
+		return s.Check(Message{SenderID: conn, Sender: sender, PartnerID: partner, Text: text}).Action
+	}
+
+	if got := send("c1", "device:d1", "p1", ad); got != Allow {
+		t.Fatalf("first partner: %v", got)
+	}
+	if got := send("c1", "device:d1", "p1", ad); got != Allow {
+		t.Fatalf("same partner again: %v", got)
+	}
+	if got := send("c1", "device:d1", "p2", "VISIT my   site for free stuff"); got != Allow {
+		t.Fatalf("second partner: %v", got)
+	}
+	// a new connection, as after a reconnect or on another server
+	if got := send("c2", "device:d1", "p3", ad); got != Flag {
+		t.Fatalf("third partner after reconnect: %v, want %v", got, Flag)
+	}
+
+	if got := send("c3", "device:d2", "p4", ad); got != Allow {
+		t.Fatalf("another sender: %v", got)
+	}
+	if got := send("c1", "device:d1", "p5", "a different message"); got != Allow {
+		t.Fatalf("different text: %v", got)
+	}
+	for _, p := range []string{"p5", "p6", "p7"} {
+		if got := send("c1", "device:d1", p, "hey"); got != Allow {
+			t.Fatalf("short message: %v", got)
+		}
+	}
+
+	// old sends drop out of the window
+	short := NewSpam(2, 50*time.Millisecond, Flag)
+	short.Check(Message{Sender: "ip:1", PartnerID: "p1", Text: ad})
+	time.Sleep(60 * time.Millisecond)
+	if got := short.Check(Message{Sender: "ip:1", PartnerID: "p2", Text: ad}).Action; got != Allow {
+		t.Fatalf("after window: %v", got)
+	}
+
+	// without Redis, messages go through
+	m.Close()
+	if got := send("c1", "device:d1", "p8", ad); got != Allow {
+		t.Fatalf("redis down: %v", got)
+	}
+}
@@ -0,0 +1,76 @@
+package filter
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var linkRe = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+|\b[a-z0-9-]+(?:\.[a-z0-9-]+)*\.(?:com|net|org|io|gg|me|co|xyz|ru|tk|ly|link|app|dev|info|biz)(?:/[^\s<>"]*)?\b`)
+
+// Links blocks or redacts URLs whose host is not on the allowlist. An empty
+// allowlist means no link is allowed.
+type Links struct {
+	allow  []string
+	action Action
+}
+
+func NewLinks(allowlist []string, action Action) *Links {
+	if action == Allow {
+		action = Block
+	}
+
+	l := &Links{action: action}
+	for _, d := range allowlist {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d != "" {
+			l.allow = append(l.allow, strings.TrimPrefix(d, "*."))
+		}
+	}
+	return l
+}
+
+func (l *Links) Name() string { return "links" }
+
+func (l *Links) Check(msg Message) Result {
+	var b strings.Builder
+	last := 0
+	for _, loc := range linkRe.FindAllStringIndex(msg.Text, -1) {
+		link := msg.Text[loc[0]:loc[1]]
+		// the domain half of an email address is the PII filter's job
+		if loc[0] > 0 && msg.Text[loc[0]-1] == '@' {
+			continue
+		}
+		if l.allowed(link) {
+			continue
+		}
+		b.WriteString(msg.Text[last:loc[0]])
+		b.WriteString("[link removed]")
+		last = loc[1]
+	}
+
+	if last == 0 {
+		return Result{Action: Allow}
+	}
+	b.WriteString(msg.Text[last:])
+	return Result{Action: l.action, Text: b.String(), Reason: "link not allowed"}
+}
+
+func (l *Links) allowed(link string) bool {
+	raw := link
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, d := range l.allow {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
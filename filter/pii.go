@@ -0,0 +1,51 @@
+package filter
+
+import "regexp"
+
+var (
+	emailRe = regexp.MustCompile(`(?i)\b[a-z0-9._%+-]+@[a-z0-9.-]+\.[a-z]{2,}\b`)
+	phoneRe = regexp.MustCompile(`(?:\+?\d{1,3}[\s.-]?)?(?:\(\d{2,4}\)[\s.-]?)?\d{3,4}[\s.-]?\d{3,4}(?:[\s.-]?\d{2,4})?`)
+)
+
+// PII redacts phone numbers and email addresses so strangers can't swap
+// contact details through the chat.
+type PII struct {
+	phones bool
+	emails bool
+}
+
+func NewPII(phones, emails bool) *PII {
+	return &PII{phones: phones, emails: emails}
+}
+
+func (p *PII) Name() string { return "pii" }
+
+func (p *PII) Check(msg Message) Result {
+	text := msg.Text
+	if p.emails {
+		text = emailRe.ReplaceAllString(text, "[email removed]")
+	}
+	if p.phones {
+		text = phoneRe.ReplaceAllStringFunc(text, func(m string) string {
+			if countDigits(m) < 7 {
+				return m
+			}
+			return "[phone removed]"
+		})
+	}
+
+	if text == msg.Text {
+		return Result{Action: Allow}
+	}
+	return Result{Action: Redact, Text: text, Reason: "contact details"}
+}
+
+func countDigits(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,119 @@
+package filter
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var defaultProfanity = []string{
+	"fuck", "shit", "bitch", "cunt", "asshole", "dick", "pussy", "bastard", "slut", "whore",
+}
+
+var leet = map[rune]rune{
+	'0': 'o',
+	'1': 'i',
+	'!': 'i',
+	'|': 'i',
+	'3': 'e',
+	'4': 'a',
+	'@': 'a',
+	'5': 's',
+	'$': 's',
+	'7': 't',
+	'+': 't',
+	'8': 'b',
+	'9': 'g',
+}
+
+var wordRe = regexp.MustCompile(`[\p{L}\p{N}@$!|+*._-]+`)
+
+type Profanity struct {
+	words  map[string]struct{}
+	action Action
+}
+
+func NewProfanity(words []string, action Action) *Profanity {
+	if len(words) == 0 {
+		words = defaultProfanity
+	}
+	if action == Allow {
+		action = Redact
+	}
+
+	p := &Profanity{words: make(map[string]struct{}, len(words)), action: action}
+	for _, w := range words {
+		if n := normalizeWord(w); n != "" {
+			p.words[n] = struct{}{}
+		}
+	}
+	return p
+}
+
+func (p *Profanity) Name() string { return "profanity" }
+
+func (p *Profanity) Check(msg Message) Result {
+	hit := false
+	text := wordRe.ReplaceAllStringFunc(msg.Text, func(tok string) string {
+		start, end, ok := p.match(tok)
+		if !ok {
+			return tok
+		}
+		hit = true
+		return tok[:start] + strings.Repeat("*", len([]rune(tok[start:end]))) + tok[end:]
+	})
+
+	if !hit {
+		return Result{Action: Allow}
+	}
+	return Result{Action: p.action, Text: text, Reason: "profanity"}
+}
+
+// match finds a listed word in tok and returns the span to redact. Symbols
+// that double as leetspeak, like '!' and '$', are also ordinary punctuation,
+// so "shit!" and "$hit" must both match: the token is tried with symbols
+// trimmed from both ends, then from one end, then as is.
+func (p *Profanity) match(tok string) (start, end int, ok bool) {
+	core := strings.TrimRightFunc(tok, isSymbol)
+	lead := len(core) - len(strings.TrimLeftFunc(core, isSymbol))
+	candidates := [][2]int{
+		{lead, len(core)},
+		{0, len(core)},
+		{lead, len(tok)},
+		{0, len(tok)},
+	}
+	for _, c := range candidates {
+		if c[0] >= c[1] {
+			continue
+		}
+		if _, ok := p.words[normalizeWord(tok[c[0]:c[1]])]; ok {
+			return c[0], c[1], true
+		}
+	}
+	return 0, 0, false
+}
+
+func isSymbol(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// normalizeWord lowercases, undoes leetspeak, drops separators and collapses
+// repeated letters so "F.u.u.u.c.k" and "fuuuck" both become "fuck".
+func normalizeWord(s string) string {
+	var b strings.Builder
+	var last rune
+	for _, r := range strings.ToLower(s) {
+		if m, ok := leet[r]; ok {
+			r = m
+		}
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		if r == last {
+			continue
+		}
+		b.WriteRune(r)
+		last = r
+	}
+	return b.String()
+}
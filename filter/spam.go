@@ -0,0 +1,62 @@
+package filter
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"log/slog"
+	"omiro/redis"
+	"strings"
+	"time"
+)
+
+// Spam catches a sender pasting the same message to many different partners,
+// the usual pattern for bots advertising through random chat. Counts are
+// kept in Redis under the sender's stable identity, so reconnecting or
+// landing on another server doesn't reset them.
+type Spam struct {
+	partners int
+	window   time.Duration
+	action   Action
+}
+
+func NewSpam(partners int, window time.Duration, action Action) *Spam {
+	if partners <= 0 {
+		partners = 3
+	}
+	if window <= 0 {
+		window = 10 * time.Minute
+	}
+	if action == Allow {
+		action = Flag
+	}
+	return &Spam{
+		partners: partners,
+		window:   window,
+		action:   action,
+	}
+}
+
+func (s *Spam) Name() string { return "spam" }
+
+func (s *Spam) Check(msg Message) Result {
+	norm := strings.Join(strings.Fields(strings.ToLower(msg.Text)), " ")
+	if len(norm) < 8 {
+		return Result{Action: Allow}
+	}
+
+	sender := msg.Sender
+	if sender == "" {
+		sender = msg.SenderID
+	}
+	sum := sha1.Sum([]byte(norm))
+
+	n, err := redis.CountMessagePartners(redis.Ctx, sender, hex.EncodeToString(sum[:]), msg.PartnerID, s.window)
+	if err != nil {
+		slog.Warn("spam filter unavailable", "err", err)
+		return Result{Action: Allow}
+	}
+	if n < int64(s.partners) {
+		return Result{Action: Allow}
+	}
+	return Result{Action: s.action, Reason: "same message sent to multiple partners"}
+}
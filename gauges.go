@@ -0,0 +1,35 @@
+package main
+
+import "omiro/metrics"
+
+// registerGauges exposes the live client, queue and pairing counts from
+// this server's in-memory state, and whether it is the leader.
+func registerGauges() {
+	metrics.RegisterGauges(
+		func() float64 {
+			return float64(connectedClients())
+		},
+		func() float64 {
+			queueMu.Lock()
+			defer queueMu.Unlock()
+			return float64(len(queue))
+		},
+		func() float64 {
+			clientsMu.RLock()
+			defer clientsMu.RUnlock()
+			paired := 0
+			for _, c := range clients {
+				if c.Partner != nil {
+					paired++
+				}
+			}
+			return float64(paired / 2)
+		},
+		func() float64 {
+			if leader.Held() {
+				return 1
+			}
+			return 0
+		},
+	)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"omiro/config"
+	"omiro/helper"
+	"omiro/middleware"
+	"omiro/oidc"
+	"omiro/redis"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// oidcProvider is nil unless registered accounts are enabled, in which case
+// anonymous sessions keep working alongside logins.
+var oidcProvider *oidc.Provider
+
+const (
+	oidcStateTTL = 10 * time.Minute
+	// ties a login to the browser that started it, so an attacker can't
+	// finish their own login in someone else's browser (login CSRF)
+	oidcStateCookie = "omiro_oidc_state"
+)
+
+// loadOIDC enables login when an issuer is configured, or mock mode for a
+// local mock identity provider mounted at /mock-idp.
+func loadOIDC(e *echo.Echo, c config.OIDCConfig) {
+	oc := oidc.Config{
+		Issuer:       c.Issuer,
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		RedirectURL:  c.RedirectURL,
+		Scopes:       c.Scopes,
+	}
+
+	if c.Mock {
+		slog.Warn("mock identity provider enabled, do not use in production")
+		oc.Issuer = c.MockIssuer
+		e.Any("/mock-idp/*", echo.WrapHandler(oidc.NewMockProvider(oc.Issuer)))
+	}
+
+	if oc.Issuer == "" {
+		return
+	}
+	oidcProvider = oidc.New(oc)
+
+	e.GET("/auth/login", handleAuthLogin)
+	e.GET("/auth/callback", handleAuthCallback)
+	slog.Info("OIDC login enabled", "issuer", oc.Issuer)
+}
+
+// handleAuthLogin starts a login. It runs the same maintenance and challenge
+// checks as /session/new, so logging in is no way around them.
+func handleAuthLogin(c echo.Context) error {
+	r := c.Request()
+	if msg, ok := underMaintenance(r.Context()); ok {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": msg, "code": "maintenance"})
+	}
+	if err := middleware.VerifyChallenge(r); err != nil {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+	}
+
+	req := oidc.NewAuthRequest()
+	b, _ := json.Marshal(req)
+	if err := redis.SaveAuthRequest(req.State, b, oidcStateTTL); err != nil {
+		slog.Error("failed to save login state", "err", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Login unavailable"})
+	}
+
+	authURL, err := oidcProvider.AuthURL(c.Request().Context(), req)
+	if err != nil {
+		slog.Error("oidc auth url error", "err", err)
+		return c.JSON(http.StatusBadGateway, map[string]string{"error": "Login unavailable"})
+	}
+	setStateCookie(c, req.State, int(oidcStateTTL.Seconds()))
+	return c.Redirect(http.StatusFound, authURL)
+}
+
+func handleAuthCallback(c echo.Context) error {
+	state := c.QueryParam("state")
+	code := c.QueryParam("code")
+	if state == "" || code == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Missing code or state"})
+	}
+
+	cookie, err := c.Cookie(oidcStateCookie)
+	setStateCookie(c, "", -1)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Login expired, try again"})
+	}
+
+	raw, err := redis.TakeAuthRequest(state)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Login expired, try again"})
+	}
+	var req oidc.AuthRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Login expired, try again"})
+	}
+
+	claims, err := oidcProvider.Exchange(c.Request().Context(), code, req)
+	if err != nil {
+		slog.Warn("oidc exchange failed", "err", err)
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Login failed"})
+	}
+
+	userID := stableUserID(claims.Issuer, claims.Subject)
+	banned, reason, err := redis.IsUserBanned(c.Request().Context(), userID)
+	if err != nil {
+		// fail closed: a ban that can't be checked must not be bypassed
+		slog.Error("ban check failed", "user_id", userID, "err", err)
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Login unavailable"})
+	}
+	if banned {
+		slog.Info("banned user tried to log in", "user_id", userID, "ip", helper.GetRealIP(c.Request()), "reason", reason)
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Banned"})
+	}
+
+	// maintenance may have started while the user was at the provider
+	if msg, ok := underMaintenance(c.Request().Context()); ok {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": msg, "code": "maintenance"})
+	}
+
+	deviceID := middleware.EnsureDevice(c.Response(), c.Request())
+	_, token, err := middleware.IssueSession(c.Request(), map[string]string{"uid": userID, "did": deviceID})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate session token"})
+	}
+
+	// the fragment never reaches server logs; the frontend picks it up
+	return c.Redirect(http.StatusFound, "/#token="+url.QueryEscape(token))
+}
+
+// setStateCookie remembers the login state in the browser until the
+// provider redirects back. A negative maxAge clears it.
+func setStateCookie(c echo.Context, state string, maxAge int) {
+	r := c.Request()
+	c.SetCookie(&http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/auth/callback",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// stableUserID derives an opaque user ID that stays the same across logins
+// and doesn't expose the provider's subject.
+func stableUserID(issuer, subject string) string {
+	sum := sha256.Sum256([]byte(issuer + "|" + subject))
+	return "u_" + hex.EncodeToString(sum[:16])
+}
+
+// handleDeviceReset lets a user drop their device ID. Banned devices can't
+// reset their way out of the ban.
+func handleDeviceReset(c echo.Context) error {
+	if id := middleware.DeviceID(c.Request()); id != "" {
+		banned, _, err := redis.IsDeviceBanned(c.Request().Context(), id)
+		if err != nil {
+			// a banned device must not get a clean ID because Redis blinked
+			slog.Error("ban check failed", "device_id", id, "err", err)
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Device reset unavailable"})
+		}
+		if banned {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Banned"})
+		}
+	}
+	middleware.ResetDevice(c.Response(), c.Request())
+	return c.JSON(http.StatusOK, map[string]string{"status": "reset"})
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"omiro/config"
+	"omiro/middleware"
+	"omiro/redis"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/labstack/echo/v4"
+)
+
+// authTest runs the login routes against the mock identity provider, both
+// served by one test server, with Redis in miniredis.
+type authTest struct {
+	t     *testing.T
+	srv   *httptest.Server
+	redis *miniredis.Miniredis
+}
+
+func newAuthTest(t *testing.T) *authTest {
+	t.Helper()
+	m := miniredis.RunT(t)
+	if err := redis.Init(redis.Config{Host: m.Host(), Port: m.Port()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := middleware.UseEphemeralKey(); err != nil {
+		t.Fatal(err)
+	}
+	middleware.UseEphemeralDeviceKey()
+	middleware.SetChallenge(nil)
+
+	e := echo.New()
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { oidcProvider = nil })
+	loadOIDC(e, config.OIDCConfig{
+		ClientID:    "omiro",
+		RedirectURL: srv.URL + "/auth/callback",
+		Mock:        true,
+		MockIssuer:  srv.URL + "/mock-idp",
+	})
+	return &authTest{t: t, srv: srv, redis: m}
+}
+
+// client returns a browser with its own cookie jar that doesn't follow
+// redirects, so each step of the login can be inspected.
+func (a *authTest) client() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// login starts a login in browser and returns the callback URL the
+// provider sent it back to.
+func (a *authTest) login(browser *http.Client, hint string) string {
+	a.t.Helper()
+	resp, err := browser.Get(a.srv.URL + "/auth/login")
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		a.t.Fatalf("login: status %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+
+	// the provider picks the subject from login_hint on its authorize URL
+	authURL, err := resp.Location()
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	q := authURL.Query()
+	q.Set("login_hint", hint)
+	authURL.RawQuery = q.Encode()
+
+	resp, err = browser.Get(authURL.String())
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := resp.Location()
+	if err != nil {
+		a.t.Fatalf("authorize: %v", err)
+	}
+	return callback.String()
+}
+
+// callback finishes a login and returns the response status and the
+// session token, if one was issued.
+func (a *authTest) callback(browser *http.Client, callbackURL string) (int, string) {
+	a.t.Helper()
+	resp, err := browser.Get(callbackURL)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	token, _ := strings.CutPrefix(resp.Header.Get("Location"), "/#token=")
+	token, _ = url.QueryUnescape(token)
+	return resp.StatusCode, token
+}
+
+func TestAuthLoginIssuesUserSession(t *testing.T) {
+	a := newAuthTest(t)
+	browser := a.client()
+
+	status, token := a.callback(browser, a.login(browser, "alice"))
+	if status != http.StatusFound || token == "" {
+		t.Fatalf("callback: status %d, token %q", status, token)
+	}
+
+	session, err := middleware.ParseSession(token, httptest.NewRequest(http.MethodGet, "/ws", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := stableUserID(a.srv.URL+"/mock-idp", "alice")
+	if got := session.UserID(); got != want {
+		t.Fatalf("uid = %q, want %q", got, want)
+	}
+	if session.DeviceID() == "" {
+		t.Fatal("session has no device ID")
+	}
+
+	// the same subject always maps to the same user
+	_, again := a.callback(browser, a.login(browser, "alice"))
+	session, err = middleware.ParseSession(again, httptest.NewRequest(http.MethodGet, "/ws", nil))
+	if err != nil || session.UserID() != want {
+		t.Fatalf("second login: uid %q, err %v", session.UserID(), err)
+	}
+}
+
+func TestAuthCallbackRejectsReusedState(t *testing.T) {
+	a := newAuthTest(t)
+	browser := a.client()
+
+	callbackURL := a.login(browser, "alice")
+	u, _ := url.Parse(callbackURL)
+	state := u.Query().Get("state")
+
+	if status, _ := a.callback(browser, callbackURL); status != http.StatusFound {
+		t.Fatalf("first callback: status %d", status)
+	}
+
+	// replay the callback with the state cookie put back
+	req, _ := http.NewRequest(http.MethodGet, callbackURL, nil)
+	req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: state})
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("reused state: status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestAuthCallbackRejectsExpiredState(t *testing.T) {
+	a := newAuthTest(t)
+	browser := a.client()
+
+	callbackURL := a.login(browser, "alice")
+	a.redis.FastForward(oidcStateTTL + time.Second)
+
+	if status, _ := a.callback(browser, callbackURL); status != http.StatusBadRequest {
+		t.Fatalf("expired state: status %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestAuthCallbackNeedsStateCookie(t *testing.T) {
+	a := newAuthTest(t)
+	browser := a.client()
+	callbackURL := a.login(browser, "alice")
+
+	// a callback URL opened in another browser (login CSRF) is refused
+	if status, _ := a.callback(a.client(), callbackURL); status != http.StatusBadRequest {
+		t.Fatalf("no cookie: status %d, want %d", status, http.StatusBadRequest)
+	}
+
+	// as is one whose cookie belongs to a different login
+	other := a.client()
+	a.login(other, "mallory")
+	otherCookies := other.Jar.Cookies(mustParseURL(t, callbackURL))
+	if len(otherCookies) != 1 {
+		t.Fatalf("got %d state cookies, want 1", len(otherCookies))
+	}
+	req, _ := http.NewRequest(http.MethodGet, callbackURL, nil)
+	req.AddCookie(otherCookies[0])
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("mismatched cookie: status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	// neither attempt used up the state for the browser that started it
+	if status, token := a.callback(browser, callbackURL); status != http.StatusFound || token == "" {
+		t.Fatalf("own callback: status %d, token %q", status, token)
+	}
+}
+
+func TestAuthLoginRefusedDuringMaintenance(t *testing.T) {
+	a := newAuthTest(t)
+	if err := redis.SetMaintenance(redis.Ctx, true, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := a.client().Get(a.srv.URL + "/auth/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+func TestAuthCallbackFailsClosedWhenBanCheckFails(t *testing.T) {
+	a := newAuthTest(t)
+	browser := a.client()
+
+	// a ban key GET can't read makes the ban check error out
+	userID := stableUserID(a.srv.URL+"/mock-idp", "alice")
+	a.redis.Lpush("ban:user:"+userID, "x")
+
+	if status, token := a.callback(browser, a.login(browser, "alice")); status != http.StatusServiceUnavailable || token != "" {
+		t.Fatalf("status %d, token %q, want %d and no token", status, token, http.StatusServiceUnavailable)
+	}
+}
+
+func TestDeviceResetChecksBan(t *testing.T) {
+	a := newAuthTest(t)
+
+	rec := httptest.NewRecorder()
+	middleware.EnsureDevice(rec, httptest.NewRequest(http.MethodPost, "/device/reset", nil))
+	cookie := rec.Result().Cookies()[0]
+
+	req := httptest.NewRequest(http.MethodPost, "/device/reset", nil)
+	req.AddCookie(cookie)
+	id := middleware.DeviceID(req)
+	if id == "" {
+		t.Fatal("device cookie did not verify")
+	}
+
+	reset := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/device/reset", nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		if err := handleDeviceReset(echo.New().NewContext(req, rec)); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code
+	}
+
+	tests := []struct {
+		name  string
+		setup func()
+		want  int
+	}{
+		{"not banned", func() {}, http.StatusOK},
+		{"banned", func() { a.redis.Set("ban:device:"+id, "spam") }, http.StatusForbidden},
+		{"ban check fails", func() { a.redis.Del("ban:device:" + id); a.redis.Lpush("ban:device:"+id, "x") }, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			if got := reset(); got != tt.want {
+				t.Fatalf("status %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
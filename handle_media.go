@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"omiro/config"
+	"omiro/helper"
+	"omiro/media"
+	"omiro/metrics"
+	"omiro/middleware"
+	"omiro/redis"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	mediaStore    media.Store
+	mediaMaxBytes int64
+	mediaTTL      time.Duration
+)
+
+func loadMediaStore(c config.MediaConfig) (media.Store, error) {
+	mediaMaxBytes = c.MaxBytes
+	mediaTTL = c.TTL
+
+	secret := []byte(c.Secret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+		slog.Warn("media secret not set, media URLs are only valid on this server")
+	}
+
+	return media.New(media.Config{
+		Backend: c.Store,
+		Secret:  secret,
+		Dir:     c.Dir,
+		BaseURL: c.BaseURL,
+		TTL:     mediaTTL,
+		S3: media.S3Config{
+			Endpoint:  c.S3.Endpoint,
+			Region:    c.S3.Region,
+			Bucket:    c.S3.Bucket,
+			AccessKey: c.S3.AccessKey,
+			SecretKey: c.S3.SecretKey,
+			PathStyle: c.S3.PathStyle,
+		},
+	})
+}
+
+func handleMediaUpload(c echo.Context) error {
+	r := c.Request()
+
+	ok, err := redis.CheckRateLimit(r.Context(), "upload:"+helper.GetRealIP(r), cfg.RateLimit.Upload, time.Minute)
+	if err != nil || !ok {
+		return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "Too many uploads"})
+	}
+
+	session, err := middleware.ParseSession(middleware.TokenFromRequest(r), r)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	sender := clientBySession(session.ID)
+	if sender == nil {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "No active connection for session"})
+	}
+	clientsMu.RLock()
+	partner := sender.Partner
+	clientsMu.RUnlock()
+	if partner == nil {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Not paired"})
+	}
+
+	// leave room for the multipart envelope
+	r.Body = http.MaxBytesReader(c.Response(), r.Body, mediaMaxBytes+64<<10)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Missing file"})
+	}
+	defer file.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(file, mediaMaxBytes+1))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read file"})
+	}
+
+	data, contentType, err := media.Sanitize(raw, mediaMaxBytes)
+	switch {
+	case errors.Is(err, media.ErrTooLarge):
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": err.Error()})
+	case errors.Is(err, media.ErrUnsupportedType):
+		return c.JSON(http.StatusUnsupportedMediaType, map[string]string{"error": err.Error()})
+	case err != nil:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	id := uuid.NewString()
+	key := id + media.Extension(contentType)
+	if err := mediaStore.Put(key, contentType, data); err != nil {
+		sender.logger().Error("media store error", "err", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store file"})
+	}
+
+	url, err := mediaStore.URL(key, mediaTTL)
+	if err != nil {
+		sender.logger().Error("media url error", "err", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store file"})
+	}
+	expiresAt := time.Now().Add(mediaTTL).Unix()
+
+	partner.mu.Lock()
+	partner.rememberReceived(id)
+	partner.mu.Unlock()
+
+	if err := redis.StoreChatMessage(r.Context(), sender.RoomID, redis.ChatMessage{
+		ID:       id,
+		SenderID: sender.ID,
+		Media:    key,
+	}, ""); err != nil {
+		sender.logger().Error("failed to store chat media", "err", err)
+	}
+
+	metrics.ChatMessages.WithLabelValues("media", "delivered").Inc()
+	sendJSON(partner, map[string]any{
+		"op":         "chat_media",
+		"id":         id,
+		"url":        url,
+		"mime":       contentType,
+		"size":       len(data),
+		"expires_at": expiresAt,
+	})
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"id":         id,
+		"url":        url,
+		"expires_at": expiresAt,
+	})
+}
+
+// handleMediaGet serves files from the local store through signed URLs.
+func handleMediaGet(c echo.Context) error {
+	local, ok := mediaStore.(*media.Local)
+	if !ok {
+		return echo.ErrNotFound
+	}
+
+	path, err := local.Verify(c.Param("key"), c.QueryParam("exp"), c.QueryParam("sig"))
+	if err != nil {
+		return echo.ErrNotFound
+	}
+
+	c.Response().Header().Set("Cache-Control", "private, no-store")
+	c.Response().Header().Set("X-Content-Type-Options", "nosniff")
+	return c.File(path)
+}
+
+func clientBySession(sessionID string) *Client {
+	if sessionID == "" {
+		return nil
+	}
+
+	clientsMu.RLock()
+	defer clientsMu.RUnlock()
+	for _, c := range clients {
+		if c.Session != nil && c.Session.ID == sessionID {
+			return c
+		}
+	}
+	return nil
+}
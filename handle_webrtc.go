@@ -2,9 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"log"
-
-	"github.com/gorilla/websocket"
 )
 
 func handleWebRTCOffer(c *Client, data json.RawMessage) {
@@ -17,7 +14,7 @@ func handleWebRTCOffer(c *Client, data json.RawMessage) {
 	}
 
 	if err := json.Unmarshal(data, &payload); err != nil {
-		log.Println("invalid offer:", err)
+		c.logger().Warn("invalid payload", "op", "webrtc_offer", "err", err)
 		return
 	}
 
@@ -35,7 +32,7 @@ func handleWebRTCOffer(c *Client, data json.RawMessage) {
 	}
 
 	bytes, _ := json.Marshal(outgoing)
-	partner.Send <- SendMessageType{Type: websocket.TextMessage, Message: bytes}
+	partner.enqueue(bytes)
 }
 
 func handleWebRTCAnswer(c *Client, data json.RawMessage) {
@@ -48,7 +45,7 @@ func handleWebRTCAnswer(c *Client, data json.RawMessage) {
 	}
 
 	if err := json.Unmarshal(data, &payload); err != nil {
-		log.Println("invalid answer:", err)
+		c.logger().Warn("invalid payload", "op", "webrtc_answer", "err", err)
 		return
 	}
 
@@ -66,7 +63,7 @@ func handleWebRTCAnswer(c *Client, data json.RawMessage) {
 	}
 
 	bytes, _ := json.Marshal(outgoing)
-	partner.Send <- SendMessageType{Type: websocket.TextMessage, Message: bytes}
+	partner.enqueue(bytes)
 }
 
 func handleICECandidate(c *Client, data json.RawMessage) {
@@ -79,7 +76,7 @@ func handleICECandidate(c *Client, data json.RawMessage) {
 	}
 
 	if err := json.Unmarshal(data, &payload); err != nil {
-		log.Println("invalid ice candidate:", err)
+		c.logger().Warn("invalid payload", "op", "ice_candidate", "err", err)
 		return
 	}
 
@@ -97,7 +94,7 @@ func handleICECandidate(c *Client, data json.RawMessage) {
 	}
 
 	bytes, _ := json.Marshal(outgoing)
-	partner.Send <- SendMessageType{Type: websocket.TextMessage, Message: bytes}
+	partner.enqueue(bytes)
 }
 
 func safeGetClient(id string) *Client {
@@ -2,55 +2,75 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
+	"omiro/helper"
+	"omiro/metrics"
 	"omiro/middleware"
 	"omiro/redis"
+	"omiro/tracing"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 var clients = make(map[string]*Client)
 var clientsMu sync.RWMutex
 
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	if !middleware.EnsureUpgradeChecks(w, r) {
+	client := acceptClient(w, r)
+	if client == nil {
 		return
 	}
+	defer client.Conn.Close()
+	client.readPump()
+}
+
+// acceptClient runs the handshake checks, upgrades the connection and
+// registers the client. It returns nil if the client was turned away.
+func acceptClient(w http.ResponseWriter, r *http.Request) *Client {
+	r, span := tracing.StartHTTP(r, "ws.upgrade")
+	defer span.End()
+
+	if draining.Load() {
+		metrics.RejectedHandshakes.WithLabelValues("draining").Inc()
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return nil
+	}
+	session, ok := middleware.EnsureUpgradeChecks(w, r)
+	if !ok {
+		span.SetStatus(codes.Error, "rejected")
+		return nil
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
-	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	if err != nil {
+		metrics.RejectedHandshakes.WithLabelValues("upgrade_failed").Inc()
+		slog.Warn("websocket upgrade failed", "err", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "upgrade failed")
+		return nil
+	}
+	conn.SetReadDeadline(time.Now().Add(cfg.WebSocket.PongTimeout))
 	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		conn.SetReadDeadline(time.Now().Add(cfg.WebSocket.PongTimeout))
 		return nil
 	})
-	if err != nil {
-		log.Println("upgrade error:", err)
-		return
-	}
-	defer conn.Close()
-	log.Println("client connected:", conn.RemoteAddr())
 
 	client := &Client{
-		ID:   uuid.NewString(),
-		Conn: conn,
-		Send: make(chan SendMessageType, 256),
-	}
-
-	clientsMu.Lock()
-	clients[client.ID] = client
-	clientsMu.Unlock()
+		ID:      uuid.NewString(),
+		Session: session,
+		IP:      helper.GetRealIP(r),
+		Conn:    conn,
+		Send:    make(chan SendMessageType, cfg.WebSocket.SendQueueSize),
+		upgrade: span.SpanContext(),
 
-	ip := r.RemoteAddr
-	if err := redis.RegisterClient(client.ID, ip, serverID); err != nil {
-		log.Println("failed to register client in redis:", err)
-		return
+		connectedAt: time.Now(),
 	}
-
-	go client.writePump()
-	go client.readPump()
+	span.SetAttributes(attribute.String("client.id", client.ID))
 
 	welcomeMsg := map[string]any{
 		"message":   "Hello from server",
@@ -60,14 +80,66 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	msgBytes, err := json.Marshal(welcomeMsg)
 	if err != nil {
-		log.Println("json marshal error:", err)
-		return
+		client.logger().Error("json marshal error", "err", err)
+		conn.Close()
+		return nil
 	}
 
-	client.Send <- SendMessageType{
-		Message: msgBytes,
-		Type:    websocket.TextMessage,
+	// register in Redis before the client becomes visible locally, so a
+	// failure leaves nothing behind to clean up
+	if err := redis.RegisterClient(r.Context(), client.ID, client.IP, session.DeviceID(), serverID); err != nil {
+		client.logger().Error("failed to register client in redis", "err", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "register failed")
+		conn.Close()
+		return nil
+	}
+
+	clientsMu.Lock()
+	clients[client.ID] = client
+	clientsMu.Unlock()
+	client.logger().Info("client connected", "ip", client.IP)
+
+	go client.writePump()
+
+	client.enqueue(msgBytes)
+
+	// catch up on an announcement made before the client connected
+	if a, err := redis.ActiveAnnouncement(r.Context()); err != nil {
+		client.logger().Warn("failed to load announcement", "err", err)
+	} else if a != nil {
+		sendJSON(client, announcementMessage(*a))
 	}
+	return client
+}
 
-	select {}
+// localClientMetas describes every client connected here as it should look
+// in Redis, for registering them again after Redis forgot this server.
+func localClientMetas() []redis.ClientMeta {
+	queueMu.Lock()
+	queued := slices.Clone(queue)
+	queueMu.Unlock()
+
+	clientsMu.RLock()
+	defer clientsMu.RUnlock()
+	metas := make([]redis.ClientMeta, 0, len(clients))
+	for _, c := range clients {
+		meta := redis.ClientMeta{
+			ID:          c.ID,
+			IP:          c.IP,
+			DeviceID:    c.Session.DeviceID(),
+			ServerID:    serverID,
+			Mode:        c.Mode,
+			ConnectedAt: c.connectedAt.Unix(),
+		}
+		if c.Partner != nil {
+			meta.PartnerID = c.Partner.ID
+		}
+		if slices.Contains(queued, c.ID) {
+			meta.InQueue = true
+			meta.QueuedAt = c.queuedAt.Unix()
+		}
+		metas = append(metas, meta)
+	}
+	return metas
 }
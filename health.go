@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"omiro/redis"
+
+	"github.com/labstack/echo/v4"
+)
+
+// handleHealthz only says the process is up and serving HTTP.
+func handleHealthz(c echo.Context) error {
+	return c.String(http.StatusOK, "ok")
+}
+
+// handleReadyz reports whether this server should get new clients. Pass
+// ?verbose=1 for the result of each check as JSON.
+func handleReadyz(c echo.Context) error {
+	checks := map[string]string{}
+	ready := true
+	record := func(name string, err error) {
+		if err != nil {
+			checks[name] = err.Error()
+			ready = false
+			return
+		}
+		checks[name] = "ok"
+	}
+
+	record("redis", redis.Ping())
+	record("signal_subscriber", redis.CheckSignalSubscriber())
+	if draining.Load() {
+		checks["draining"] = "server is shutting down"
+		ready = false
+	} else {
+		checks["draining"] = "ok"
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	if c.QueryParam("verbose") == "" {
+		if ready {
+			return c.String(status, "ok")
+		}
+		return c.String(status, "not ready")
+	}
+	return c.JSON(status, map[string]any{
+		"ready":     ready,
+		"server_id": serverID,
+		"leader":    leader.Held(),
+		"checks":    checks,
+	})
+}
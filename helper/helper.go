@@ -1,21 +1,187 @@
 package helper
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 )
 
+// Cloudflare's published edge ranges (https://www.cloudflare.com/ips/).
+var cloudflareRanges = []string{
+	"173.245.48.0/20",
+	"103.21.244.0/22",
+	"103.22.200.0/22",
+	"103.31.4.0/22",
+	"141.101.64.0/18",
+	"108.162.192.0/18",
+	"190.93.240.0/20",
+	"188.114.96.0/20",
+	"197.234.240.0/22",
+	"198.41.128.0/17",
+	"162.158.0.0/15",
+	"104.16.0.0/13",
+	"104.24.0.0/14",
+	"172.64.0.0/13",
+	"131.0.72.0/22",
+	"2400:cb00::/32",
+	"2606:4700::/32",
+	"2803:f800::/32",
+	"2405:b500::/32",
+	"2405:8100::/32",
+	"2a06:98c0::/29",
+	"2c0f:f248::/32",
+}
+
+var (
+	proxyMu    sync.RWMutex
+	trusted    = mustParseCIDRs([]string{"127.0.0.0/8", "::1/128"})
+	cloudflare []*net.IPNet
+)
+
+// SetTrustedProxies replaces the proxies whose forwarding headers we believe.
+// With useCloudflare, CF-Connecting-IP is honoured on requests that reach us
+// through a Cloudflare edge address.
+func SetTrustedProxies(cidrs []string, useCloudflare bool) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+
+	var cf []*net.IPNet
+	if useCloudflare {
+		cf = mustParseCIDRs(cloudflareRanges)
+	}
+
+	proxyMu.Lock()
+	trusted = nets
+	cloudflare = cf
+	proxyMu.Unlock()
+	return nil
+}
+
+// GetRealIP resolves the client IP. It starts at the TCP peer and walks the
+// Forwarded (RFC 7239) or X-Forwarded-For chain from right to left, skipping
+// trusted proxies, and returns the first hop it doesn't trust. Headers from
+// untrusted peers are ignored, so clients can't spoof their address.
 func GetRealIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+
+	proxyMu.RLock()
+	defer proxyMu.RUnlock()
 
-	if cfIP := r.Header.Get("CF-Connecting-IP"); cfIP != "" {
-		return cfIP
+	hops := append(forwardedChain(r), remote)
+	last := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// obfuscated or garbage hop, the proxy before it is all we know
+			return last
+		}
+		last = ip.String()
+
+		if contains(cloudflare, ip) {
+			if cf := net.ParseIP(strings.TrimSpace(r.Header.Get("CF-Connecting-IP"))); cf != nil {
+				return cf.String()
+			}
+		}
+		if !contains(trusted, ip) {
+			return last
+		}
 	}
+	return last
+}
 
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		return strings.TrimSpace(strings.Split(xff, ",")[0])
+// forwardedChain returns the client addresses listed by proxies, leftmost
+// (closest to the client) first. Forwarded wins over X-Forwarded-For.
+func forwardedChain(r *http.Request) []string {
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		var chain []string
+		for _, v := range values {
+			for _, elem := range strings.Split(v, ",") {
+				chain = append(chain, forwardedFor(elem))
+			}
+		}
+		return chain
 	}
 
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return ip
+	var chain []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			chain = append(chain, hostOnly(strings.TrimSpace(hop)))
+		}
+	}
+	return chain
+}
+
+// forwardedFor extracts the address from the for= parameter of one
+// Forwarded element, e.g. `for="[2001:db8::17]:4711";proto=https`.
+func forwardedFor(elem string) string {
+	for _, pair := range strings.Split(elem, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !strings.EqualFold(key, "for") {
+			continue
+		}
+		return hostOnly(strings.Trim(value, `"`))
+	}
+	return ""
+}
+
+// hostOnly strips the port and IPv6 brackets from a hop, as in
+// "[2001:db8::17]:4711" or "192.0.2.60:4711". Some proxies add ports to
+// X-Forwarded-For too.
+func hostOnly(value string) string {
+	if strings.HasPrefix(value, "[") {
+		if end := strings.Index(value, "]"); end > 0 {
+			return value[1:end]
+		}
+	}
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		return host
+	}
+	return value
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			if strings.Contains(c, ":") {
+				c += "/128"
+			} else {
+				c += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", c, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func mustParseCIDRs(cidrs []string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return nets
 }
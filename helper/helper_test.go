@@ -0,0 +1,114 @@
+package helper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetRealIP(t *testing.T) {
+	if err := SetTrustedProxies([]string{"10.0.0.0/8", "2001:db8:ffff::/48"}, true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetTrustedProxies([]string{"127.0.0.0/8", "::1/128"}, false) })
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string][]string
+		want    string
+	}{
+		{"direct", "203.0.113.7:4000", nil, "203.0.113.7"},
+		{"direct ipv6", "[2001:db8::7]:4000", nil, "2001:db8::7"},
+		{"remote without port", "203.0.113.7", nil, "203.0.113.7"},
+
+		// headers from untrusted peers are ignored
+		{"untrusted xff", "203.0.113.7:4000", map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.7"},
+		{"untrusted forwarded", "203.0.113.7:4000", map[string][]string{"Forwarded": {"for=198.51.100.1"}}, "203.0.113.7"},
+		{"untrusted cf", "203.0.113.7:4000", map[string][]string{"CF-Connecting-IP": {"198.51.100.1"}}, "203.0.113.7"},
+
+		{"trusted xff", "10.0.0.1:4000", map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"trusted hops skipped", "10.0.0.1:4000", map[string][]string{"X-Forwarded-For": {"198.51.100.1, 10.0.0.2,10.0.0.3"}}, "198.51.100.1"},
+		{"spoofed left of untrusted hop", "10.0.0.1:4000", map[string][]string{"X-Forwarded-For": {"1.2.3.4, 198.51.100.1"}}, "198.51.100.1"},
+		{"xff over several headers", "10.0.0.1:4000", map[string][]string{"X-Forwarded-For": {"1.2.3.4", "198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"xff with port", "10.0.0.1:4000", map[string][]string{"X-Forwarded-For": {"198.51.100.1:5555"}}, "198.51.100.1"},
+		{"xff ipv6", "10.0.0.1:4000", map[string][]string{"X-Forwarded-For": {"2001:db8::1"}}, "2001:db8::1"},
+		{"xff ipv6 with port", "10.0.0.1:4000", map[string][]string{"X-Forwarded-For": {"[2001:db8::1]:5555"}}, "2001:db8::1"},
+		{"ipv6 proxy", "[2001:db8:ffff::1]:4000", map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+
+		{"forwarded", "10.0.0.1:4000", map[string][]string{"Forwarded": {"for=198.51.100.1;proto=https"}}, "198.51.100.1"},
+		{"forwarded quoted ipv6 with port", "10.0.0.1:4000", map[string][]string{"Forwarded": {`for="[2001:db8::17]:4711"`}}, "2001:db8::17"},
+		{"forwarded chain", "10.0.0.1:4000", map[string][]string{"Forwarded": {"for=1.2.3.4, for=198.51.100.1;by=10.0.0.1, for=10.0.0.2"}}, "198.51.100.1"},
+		{"forwarded wins over xff", "10.0.0.1:4000", map[string][]string{"Forwarded": {"for=198.51.100.1"}, "X-Forwarded-For": {"198.51.100.2"}}, "198.51.100.1"},
+		{"forwarded case-insensitive key", "10.0.0.1:4000", map[string][]string{"Forwarded": {"For=198.51.100.1"}}, "198.51.100.1"},
+
+		// a hop that isn't an address stops the walk at the proxy before it
+		{"obfuscated forwarded", "10.0.0.1:4000", map[string][]string{"Forwarded": {"for=_hidden"}}, "10.0.0.1"},
+		{"unknown forwarded", "10.0.0.1:4000", map[string][]string{"Forwarded": {"for=unknown, for=10.0.0.2"}}, "10.0.0.2"},
+		{"forwarded without for", "10.0.0.1:4000", map[string][]string{"Forwarded": {"proto=https"}}, "10.0.0.1"},
+		{"garbage xff", "10.0.0.1:4000", map[string][]string{"X-Forwarded-For": {"not an ip"}}, "10.0.0.1"},
+		{"empty xff hop", "10.0.0.1:4000", map[string][]string{"X-Forwarded-For": {"198.51.100.1,"}}, "10.0.0.1"},
+		{"unterminated bracket", "10.0.0.1:4000", map[string][]string{"Forwarded": {`for="[2001:db8::17"`}}, "10.0.0.1"},
+
+		// Cloudflare's header counts only on requests from its edge
+		{"cloudflare edge", "173.245.48.10:4000", map[string][]string{"CF-Connecting-IP": {"198.51.100.1"}}, "198.51.100.1"},
+		{"cloudflare edge ipv6", "[2606:4700::1]:4000", map[string][]string{"CF-Connecting-IP": {" 2001:db8::5 "}}, "2001:db8::5"},
+		{"cloudflare behind proxy", "10.0.0.1:4000", map[string][]string{"X-Forwarded-For": {"173.245.48.10"}, "CF-Connecting-IP": {"198.51.100.1"}}, "198.51.100.1"},
+		{"cloudflare edge, bad header", "173.245.48.10:4000", map[string][]string{"CF-Connecting-IP": {"garbage"}}, "173.245.48.10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for k, vs := range tt.headers {
+				for _, v := range vs {
+					r.Header.Add(k, v)
+				}
+			}
+			if got := GetRealIP(r); got != tt.want {
+				t.Fatalf("GetRealIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetRealIPWithoutCloudflare(t *testing.T) {
+	if err := SetTrustedProxies(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetTrustedProxies([]string{"127.0.0.0/8", "::1/128"}, false) })
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "173.245.48.10:4000"
+	r.Header.Set("CF-Connecting-IP", "198.51.100.1")
+	if got := GetRealIP(r); got != "173.245.48.10" {
+		t.Fatalf("GetRealIP() = %q, want the edge address", got)
+	}
+}
+
+func TestSetTrustedProxies(t *testing.T) {
+	t.Cleanup(func() { SetTrustedProxies([]string{"127.0.0.0/8", "::1/128"}, false) })
+
+	for _, bad := range []string{"10.0.0.0/33", "nope", "2001:db8::/129"} {
+		if err := SetTrustedProxies([]string{bad}, false); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+	// bare addresses are single hosts
+	if err := SetTrustedProxies([]string{" 10.0.0.1 ", "2001:db8::1", ""}, false); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	for remote, want := range map[string]string{
+		"10.0.0.1:1":      "198.51.100.1",
+		"10.0.0.2:1":      "10.0.0.2",
+		"[2001:db8::1]:1": "198.51.100.1",
+		"[2001:db8::2]:1": "2001:db8::2",
+	} {
+		r.RemoteAddr = remote
+		if got := GetRealIP(r); got != want {
+			t.Errorf("from %s: GetRealIP() = %q, want %q", remote, got, want)
+		}
+	}
+}
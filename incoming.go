@@ -1,28 +1,40 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"net"
+	"omiro/metrics"
 	"omiro/redis"
+	"omiro/tracing"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func (c *Client) readPump() {
 	defer func() {
-		handleLeaveQueue(c)
-		notifyPartnerLeft(c.ID)
+		metrics.Disconnects.WithLabelValues(c.getCloseReason()).Inc()
+		handleLeaveQueue(context.Background(), c)
+		notifyPartnerLeft(context.Background(), c.ID)
 
 		// Remove from local memory
 		clientsMu.Lock()
 		delete(clients, c.ID)
 		clientsMu.Unlock()
+		redis.UnregisterClient(serverID, c.ID)
 
 		c.Conn.Close()
-		log.Println("client disconnected:", c.ID)
+		c.logger().Info("client disconnected", "reason", c.getCloseReason())
 	}()
 
 	for {
 		_, msg, err := c.Conn.ReadMessage()
 		if err != nil {
+			c.setCloseReason(readCloseReason(err))
 			return
 		}
 
@@ -33,7 +45,7 @@ func (c *Client) readPump() {
 		}
 
 		if err := json.Unmarshal(msg, &incoming); err != nil {
-			log.Println("json unmarshal error:", err)
+			c.logger().Warn("invalid message", "err", err)
 			continue
 		}
 
@@ -42,42 +54,73 @@ func (c *Client) readPump() {
 }
 
 func routeMessage(c *Client, op string, data json.RawMessage) {
+	ctx, span := tracing.Tracer.Start(context.Background(), "ws."+op,
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithLinks(trace.Link{SpanContext: c.upgrade}),
+		trace.WithAttributes(attribute.String("client.id", c.ID)),
+	)
+	defer span.End()
+
 	switch op {
 
 	case "join_queue":
-		handleJoinQueue(c)
+		handleJoinQueue(ctx, c, data)
 
 	case "chat":
-		handleChat(c, data)
+		handleChat(ctx, c, data)
+
+	case "chat_edit":
+		handleChatEdit(ctx, c, data)
+
+	case "chat_delete":
+		handleChatDelete(ctx, c, data)
+
+	case "chat_react":
+		handleChatReact(ctx, c, data)
+
+	case "typing_start":
+		handleTyping(c, true)
+
+	case "typing_stop":
+		handleTyping(c, false)
+
+	case "chat_read":
+		handleChatRead(c, data)
 
 	case "disconnect":
-		handleClientDisconnect(c)
+		handleClientDisconnect(ctx, c)
 
 	case "next":
-		handleNextPartner(c)
+		handleNextPartner(ctx, c)
 
 	case "webrtc_offer":
+		metrics.SignalingMessages.WithLabelValues(op).Inc()
 		handleWebRTCOffer(c, data)
 
 	case "webrtc_answer":
+		metrics.SignalingMessages.WithLabelValues(op).Inc()
 		handleWebRTCAnswer(c, data)
 
 	case "ice_candidate":
+		metrics.SignalingMessages.WithLabelValues(op).Inc()
 		handleICECandidate(c, data)
 
 	default:
-		log.Println("unknown op:", op)
+		span.SetStatus(codes.Error, "unknown op")
+		c.logger().Warn("unknown op", "op", op)
 	}
 }
 
-func handleClientDisconnect(c *Client) {
-	log.Println("client disconnected via request:", c.ID)
+func handleClientDisconnect(ctx context.Context, c *Client) {
+	c.logger().Debug("disconnect requested")
+	c.setCloseReason("requested")
 
 	// Make Redis notify partner
-	notifyPartnerLeft(c.ID)
+	notifyPartnerLeft(ctx, c.ID)
 
 	// Remove from queue
-	handleLeaveQueue(c)
+	handleLeaveQueue(ctx, c)
 
 	// Remove from memory
 	clientsMu.Lock()
@@ -87,34 +130,31 @@ func handleClientDisconnect(c *Client) {
 	c.Conn.Close()
 }
 
-func handleNextPartner(c *Client) {
-	log.Println("client looking for next partner:", c.ID)
+func handleNextPartner(ctx context.Context, c *Client) {
+	c.logger().Debug("looking for next partner")
 
 	// If client has a partner, notify them and clear relationship
+	metrics.Nexts.Inc()
 	if c.Partner != nil {
 		partner := c.Partner
+		c.endPairing()
+		partner.endPairing()
 		c.Partner = nil
 		partner.Partner = nil
 
 		// Notify partner about disconnection
-		msg := []byte(`{"op":"partner_disconnected"}`)
-		select {
-		case partner.Send <- SendMessageType{
-			Message: msg,
-			Type:    1, // websocket.TextMessage
-		}:
-			log.Printf("notified partner %s that %s is looking for next\n", partner.ID, c.ID)
-		default:
-			log.Println("failed to notify partner")
+		if partner.enqueue([]byte(`{"op":"partner_disconnected"}`)) {
+			c.logger().Debug("notified partner of next", "partner_id", partner.ID)
 		}
+		saveClientState(ctx, c, false)
+		saveClientState(ctx, partner, false)
 	}
 
 	// Client stays connected, just cleared partner relationship
 	// Frontend will automatically call join_queue after this
-	log.Printf("client %s ready for next match\n", c.ID)
 }
 
-func forwardWebRTC(c *Client, typ string, payload json.RawMessage) {
+func forwardWebRTC(ctx context.Context, c *Client, typ string, payload json.RawMessage) {
 	// Payload MUST contain "to": "<partnerID>"
 	var pkt struct {
 		To string `json:"to"`
@@ -122,18 +162,31 @@ func forwardWebRTC(c *Client, typ string, payload json.RawMessage) {
 
 	json.Unmarshal(payload, &pkt)
 	if pkt.To == "" {
-		log.Println("missing 'to' field for WebRTC op")
+		c.logger().Warn("missing to field", "op", typ)
 		return
 	}
 
-	redis.SendToClient(pkt.To, map[string]any{
+	redis.SendToClient(ctx, pkt.To, map[string]any{
 		"op":   typ,
 		"data": payload,
 	})
 }
 
-func notifyPartnerLeft(userID string) {
-	redis.SendToClient(userID, map[string]any{
+func notifyPartnerLeft(ctx context.Context, userID string) {
+	redis.SendToClient(ctx, userID, map[string]any{
 		"op": "partner_disconnected",
 	})
 }
+
+// readCloseReason classifies the error that ended readPump.
+func readCloseReason(err error) string {
+	var netErr net.Error
+	switch {
+	case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway):
+		return "client_closed"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "connection_lost"
+	}
+}
@@ -1,104 +1,246 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"omiro/metrics"
+	"omiro/redis"
+	"omiro/tracing"
 	"slices"
 	"sync"
+	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var queue []string
 var queueMu sync.Mutex
 
-func handleJoinQueue(c *Client) {
-	queueMu.Lock()
-	defer queueMu.Unlock()
+const (
+	ModeVideo = "video"
+	ModeAudio = "audio"
+	ModeText  = "text"
+)
+
+// agreedMode returns the mode two clients would talk in, or "" if they
+// can't be paired. Video and audio meet at audio; text only pairs with text.
+func agreedMode(a, b string) string {
+	switch {
+	case a == b:
+		return a
+	case a == ModeText || b == ModeText:
+		return ""
+	default:
+		return ModeAudio
+	}
+}
+
+func handleJoinQueue(ctx context.Context, c *Client, data json.RawMessage) {
+	if draining.Load() {
+		sendError(c, "server_draining", "Server is shutting down, reconnect to continue")
+		return
+	}
+	if msg, ok := underMaintenance(ctx); ok {
+		sendError(c, "maintenance", msg)
+		return
+	}
+
+	var payload struct {
+		Mode string `json:"mode"`
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &payload); err != nil {
+			c.logger().Warn("invalid payload", "op", "join_queue", "err", err)
+			return
+		}
+	}
+
+	switch payload.Mode {
+	case "":
+		payload.Mode = ModeVideo
+	case ModeVideo, ModeAudio, ModeText:
+	default:
+		sendError(c, "invalid_mode", "Mode must be video, audio or text")
+		return
+	}
 
+	queueMu.Lock()
 	if slices.Contains(queue, c.ID) {
-		log.Println("client already in queue:", c.ID)
+		queueMu.Unlock()
+		c.logger().Debug("already in queue")
 		return
 	}
+	c.Mode = payload.Mode
+	c.queuedAt = time.Now()
 	queue = append(queue, c.ID)
-	log.Println("added to queue:", c.ID)
-	findMatch(c)
+	c.logger().Debug("joined queue", "mode", c.Mode)
+	findMatch(ctx, c)
+	queueMu.Unlock()
+
+	// Redis is only updated once the queue is unlocked
+	if partner := c.Partner; partner != nil {
+		saveClientState(ctx, c, false)
+		saveClientState(ctx, partner, false)
+	} else {
+		saveClientState(ctx, c, true)
+	}
 }
 
-func handleLeaveQueue(c *Client) {
+func handleLeaveQueue(ctx context.Context, c *Client) {
 	queueMu.Lock()
 	for i, id := range queue {
 		if id == c.ID {
 			queue = append(queue[:i], queue[i+1:]...)
-			log.Println("removed from queue:", c.ID)
+			c.logger().Debug("left queue")
 			break
 		}
 	}
 	queueMu.Unlock()
 	if c.Partner != nil {
 		partner := c.Partner
+		c.endPairing()
+		partner.endPairing()
 		c.Partner = nil
 		partner.Partner = nil
 
-		log.Printf("notifying partner %s about disconnection of %s\n", partner.ID, c.ID)
-		msg := []byte(`{"op":"partner_disconnected"}`)
-		select {
-		case partner.Send <- SendMessageType{
-			Message: msg,
-			Type:    websocket.TextMessage,
-		}:
-			log.Printf("successfully notified partner %s\n", partner.ID)
-		default:
-			log.Printf("failed to notify partner %s (channel full or closed)\n", partner.ID)
-		}
+		c.logger().Debug("notifying partner of disconnect", "partner_id", partner.ID)
+		partner.enqueue([]byte(`{"op":"partner_disconnected"}`))
+		saveClientState(ctx, partner, false)
+	}
+}
+
+// saveClientState mirrors c's queue and pairing state into its Redis
+// metadata, where the admin API reads it.
+func saveClientState(ctx context.Context, c *Client, inQueue bool) {
+	partnerID := ""
+	if p := c.Partner; p != nil {
+		partnerID = p.ID
+	}
+	var queuedAt int64
+	if inQueue {
+		queuedAt = c.queuedAt.Unix()
+	}
+
+	err := redis.UpdateClient(ctx, c.ID, func(m *redis.ClientMeta) {
+		m.PartnerID = partnerID
+		m.InQueue = inQueue
+		m.Mode = c.Mode
+		m.QueuedAt = queuedAt
+	})
+	if err != nil {
+		c.logger().Warn("failed to save client state", "err", err)
+	}
+}
+
+// matchBlockSameIP also keeps anonymous clients sharing an IP apart. It is
+// off by default because whole schools and mobile carriers sit behind one IP.
+var matchBlockSameIP bool
+
+// sameIdentity stops someone being paired with their own second tab or
+// device: always for logged-in users, and by IP only if matchBlockSameIP.
+func sameIdentity(a, b *Client) bool {
+	if a.identity() != b.identity() {
+		return false
 	}
+	return a.Session.UserID() != "" || matchBlockSameIP
 }
 
-func findMatch(c *Client) {
-	log.Println("finding match for:", c.ID)
-	log.Printf("queue length: %d\n", len(queue))
+// findMatch pairs c with the longest-waiting client in the same mode, or
+// failing that, the longest-waiting client in a compatible mode. Caller
+// holds queueMu.
+func findMatch(ctx context.Context, c *Client) {
 	if len(queue) < 2 {
-		log.Println("not enough clients in queue to find match")
 		return
 	}
 
-	id1 := queue[0]
-	id2 := queue[1]
-	log.Printf("found match: %s <-> %s\n", id1, id2)
-	queue = queue[2:]
-	log.Printf("queue length after match: %d\n", len(queue))
+	_, span := tracing.Tracer.Start(ctx, "match.find",
+		trace.WithAttributes(
+			attribute.String("match.mode", c.Mode),
+			attribute.Int("match.queue_length", len(queue)),
+		),
+	)
+	defer span.End()
 
 	clientsMu.RLock()
-	c1 := clients[id1]
-	c2 := clients[id2]
+	var other *Client
+	var mode string
+	for _, id := range queue {
+		cand := clients[id]
+		if cand == nil || cand == c {
+			continue
+		}
+		if sameIdentity(cand, c) {
+			continue
+		}
+		if cand.Mode == c.Mode {
+			other, mode = cand, c.Mode
+			break
+		}
+		if m := agreedMode(cand.Mode, c.Mode); m != "" && other == nil {
+			other, mode = cand, m
+		}
+	}
 	clientsMu.RUnlock()
 
-	if c1 == nil || c2 == nil {
-		log.Println("client not found:", id1, id2)
+	if other == nil {
+		span.SetAttributes(attribute.Bool("match.found", false))
+		c.logger().Debug("no compatible client in queue", "queue_length", len(queue))
 		return
 	}
+	span.SetAttributes(
+		attribute.Bool("match.found", true),
+		attribute.String("match.agreed_mode", mode),
+		attribute.String("match.partner_id", other.ID),
+	)
+
+	queue = slices.DeleteFunc(queue, func(id string) bool {
+		return id == c.ID || id == other.ID
+	})
+
+	// the client that waited longer is the caller
+	c1, c2 := other, c
+	id1, id2 := c1.ID, c2.ID
+
+	now := time.Now()
+	metrics.Matches.WithLabelValues(mode).Inc()
+	metrics.QueueWait.WithLabelValues(c1.Mode).Observe(now.Sub(c1.queuedAt).Seconds())
+	metrics.QueueWait.WithLabelValues(c2.Mode).Observe(now.Sub(c2.queuedAt).Seconds())
+	c1.mu.Lock()
+	c1.pairedAt = now
+	c1.mu.Unlock()
+	c2.mu.Lock()
+	c2.pairedAt = now
+	c2.mu.Unlock()
+
+	roomID := uuid.NewString()
 	c1.Partner = c2
 	c2.Partner = c1
+	c1.RoomID = roomID
+	c2.RoomID = roomID
+	c1.resetChatState()
+	c2.resetChatState()
 
-	log.Println("matched:", id1, "<->", id2)
+	slog.Info("matched", "client_id", id1, "partner_id", id2, "mode", mode)
 
-	// Client 1 (first in queue) will be the caller
-	matchMsg1 := SendMessageType{
-		Type: websocket.TextMessage,
-		Message: fmt.Appendf(nil,
-			`{"op":"match_found","partner":"%s","should_call":true}`, id2,
-		),
-	}
-	c1.Send <- matchMsg1
+	// text matches have no WebRTC call, so nobody sends an offer
+	call := mode != ModeText
+
+	sendJSON(c1, map[string]any{
+		"op":          "match_found",
+		"partner":     id2,
+		"mode":        mode,
+		"should_call": call,
+	})
 
 	// Client 2 will be the callee (waits for offer)
-	matchMsg2 := SendMessageType{
-		Type: websocket.TextMessage,
-		Message: fmt.Appendf(nil,
-			`{"op":"match_found","partner":"%s","should_call":false}`, id1,
-		),
-	}
-	c2.Send <- matchMsg2
+	sendJSON(c2, map[string]any{
+		"op":          "match_found",
+		"partner":     id1,
+		"mode":        mode,
+		"should_call": false,
+	})
 
-	log.Printf("Client %s is CALLER, Client %s is CALLEE\n", id1, id2)
 }
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"omiro/redis"
+	"sync"
+)
+
+// leader elects the one server that runs cluster-wide singleton jobs.
+var leader *redis.Lease
+
+// runLeaderJobs runs every singleton job until ctx is cancelled, which
+// happens when we stop leading or shut down.
+func runLeaderJobs(ctx context.Context) {
+	jobs := []func(context.Context){
+		func(ctx context.Context) { runReaper(ctx, cfg.Cluster.ReapInterval) },
+	}
+
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			job(ctx)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,101 @@
+// Package logging sets up the process-wide slog logger and the redaction
+// applied to everything it writes.
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+type Options struct {
+	Level  string // debug, info, warn or error
+	Format string // text or json
+	// ShowIPs logs client IPs as-is. It only takes effect at debug level;
+	// otherwise IPs are replaced by a keyed hash.
+	ShowIPs bool
+	// IPSalt keys the IP hash. Servers sharing a salt produce the same hash
+	// for the same IP; without one a random per-process salt is used.
+	IPSalt string
+}
+
+// Attribute keys whose values never reach the log output.
+var redactedKeys = map[string]bool{
+	"token":         true,
+	"authorization": true,
+	"cookie":        true,
+	"secret":        true,
+	"password":      true,
+	"message":       true, // chat bodies
+	"text":          true,
+	"evidence":      true,
+}
+
+// Attribute keys holding IP addresses, hashed unless ShowIPs applies.
+var ipKeys = map[string]bool{
+	"ip":          true,
+	"remote_addr": true,
+}
+
+// Setup installs the default slog logger writing to w.
+func Setup(w io.Writer, opts Options) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(opts.Level)); err != nil {
+		return fmt.Errorf("invalid log level %q", opts.Level)
+	}
+
+	salt := []byte(opts.IPSalt)
+	if len(salt) == 0 {
+		salt = make([]byte, 32)
+		rand.Read(salt)
+	}
+	showIPs := opts.ShowIPs && level <= slog.LevelDebug
+
+	handlerOpts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			key := strings.ToLower(a.Key)
+			switch {
+			case redactedKeys[key]:
+				return slog.String(a.Key, "REDACTED")
+			case ipKeys[key] && !showIPs:
+				return slog.String(a.Key, hashIP(salt, a.Value.String()))
+			}
+			return a
+		},
+	}
+
+	var h slog.Handler
+	switch opts.Format {
+	case "", "text":
+		h = slog.NewTextHandler(w, handlerOpts)
+	case "json":
+		h = slog.NewJSONHandler(w, handlerOpts)
+	default:
+		return fmt.Errorf("invalid log format %q", opts.Format)
+	}
+
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+func hashIP(salt []byte, ip string) string {
+	if ip == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(ip))
+	return "h:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// Fatal logs at error level and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
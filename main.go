@@ -1,73 +1,295 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"omiro/config"
+	"omiro/helper"
+	"omiro/logging"
+	"omiro/metrics"
 	"omiro/middleware"
 	"omiro/redis"
+	"omiro/tracing"
 	"os"
-	"time"
+	"os/signal"
+	"strconv"
+	"syscall"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/codes"
 )
 
 var (
 	serverID = uuid.NewString()
 )
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-	ReadBufferSize:    1024,
-	WriteBufferSize:   1024,
-	HandshakeTimeout:  10 * time.Second,
-	Subprotocols:      []string{"chat"},
-	EnableCompression: true,
-}
+
+// cfg is the loaded configuration, set once at startup.
+var cfg *config.Config
+
+var upgrader websocket.Upgrader
 
 func main() {
-	host := os.Getenv("REDIS_HOST")
-	if host == "" {
-		host = "localhost"
-	}
-	port := os.Getenv("REDIS_PORT")
-	if port == "" {
-		port = "6379"
-	}
-	pass := os.Getenv("REDIS_PASS")
-	if pass == "" {
-		pass = ""
-	}
-	redis.Init(redis.Config{
-		Host:     host,
-		Port:     port,
-		Password: pass,
+	var printOnly bool
+	var err error
+	cfg, printOnly, err = config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		logging.Fatal("invalid config", "err", err)
+	}
+	if printOnly {
+		if err := cfg.Write(os.Stdout); err != nil {
+			logging.Fatal("failed to print config", "err", err)
+		}
+		return
+	}
+	if err := logging.Setup(os.Stderr, logging.Options{
+		Level:   cfg.Log.Level,
+		Format:  cfg.Log.Format,
+		ShowIPs: cfg.Log.ShowIPs,
+		IPSalt:  cfg.Log.IPSalt,
+	}); err != nil {
+		logging.Fatal("invalid log config", "err", err)
+	}
+	slog.SetDefault(slog.Default().With("server_id", serverID))
+	if cfg.Path != "" {
+		slog.Info("loaded config", "path", cfg.Path)
+	}
+
+	flushTraces, err := tracing.Setup(context.Background(), tracing.Options{
+		Exporter:    cfg.Tracing.Exporter,
+		Endpoint:    cfg.Tracing.OTLPEndpoint,
+		SampleRatio: cfg.Tracing.SampleRatio,
+		ServiceName: cfg.Tracing.ServiceName,
+		ServerID:    serverID,
+	})
+	if err != nil {
+		logging.Fatal("invalid tracing config", "err", err)
+	}
+
+	if err := redis.Init(redis.Config{
+		Host:      cfg.Redis.Host,
+		Port:      strconv.Itoa(cfg.Redis.Port),
+		Password:  cfg.Redis.Password,
+		DB:        cfg.Redis.DB,
+		ClientTTL: cfg.Redis.ClientTTL,
+		ServerTTL: cfg.Redis.ServerTTL,
+	}); err != nil {
+		logging.Fatal("redis unavailable", "err", err)
+	}
+
+	upgrader = websocket.Upgrader{
+		CheckOrigin:       middleware.CheckOrigin,
+		ReadBufferSize:    cfg.WebSocket.ReadBufferSize,
+		WriteBufferSize:   cfg.WebSocket.WriteBufferSize,
+		HandshakeTimeout:  cfg.WebSocket.HandshakeTimeout,
+		Subprotocols:      []string{"chat"},
+		EnableCompression: cfg.WebSocket.Compression,
+	}
+
+	if err := helper.SetTrustedProxies(cfg.Proxy.Trusted, cfg.Proxy.TrustCloudflare); err != nil {
+		logging.Fatal("invalid trusted proxy config", "err", err)
+	}
+
+	if err := middleware.SetOriginPolicy(middleware.OriginPolicy{
+		Allowed:        cfg.Origins.Allowed,
+		AllowLocalhost: cfg.Origins.AllowLocalhost,
+	}); err != nil {
+		logging.Fatal("invalid allowed origins", "err", err)
+	}
+
+	if err := loadSigningKeys(cfg.Session); err != nil {
+		logging.Fatal("invalid session signing keys", "err", err)
+	}
+	go reloadSigningKeysOnHUP(cfg.Session)
+	if cfg.Session.DeviceKey != "" {
+		middleware.SetDeviceKey(cfg.Session.DeviceKey)
+	} else {
+		middleware.UseEphemeralDeviceKey()
+	}
+
+	middleware.SetTokenOptions(middleware.TokenOptions{
+		TTL:           cfg.Session.TokenTTL,
+		SingleUse:     cfg.Session.SingleUse,
+		BindIP:        cfg.Session.BindIP,
+		IPv4Prefix:    cfg.Session.IPv4Prefix,
+		IPv6Prefix:    cfg.Session.IPv6Prefix,
+		BindUserAgent: cfg.Session.BindUserAgent,
+	})
+	middleware.SetHandshakeLimit(cfg.RateLimit.Handshake)
+
+	challenge, err := loadChallenge(cfg.Challenge)
+	if err != nil {
+		logging.Fatal("invalid session challenge config", "err", err)
+	}
+	middleware.SetChallenge(challenge)
+
+	filters, err := loadChatFilters(cfg.Chat)
+	if err != nil {
+		logging.Fatal("invalid chat filter config", "err", err)
+	}
+	chatFilters = filters
+
+	matchBlockSameIP = cfg.Match.BlockSameIP
+
+	store, err := loadMediaStore(cfg.Media)
+	if err != nil {
+		logging.Fatal("invalid media config", "err", err)
+	}
+	mediaStore = store
+
+	redis.RegisterServer(serverID, localClientMetas)
+	if err := redis.StartSignalSubscriber(serverID, deliverToClient); err != nil {
+		logging.Fatal("signal subscriber failed", "err", err)
+	}
+	leader = redis.NewLease("jobs", serverID, cfg.Cluster.LeaseTTL)
+	goBackground(func(ctx context.Context) {
+		leader.Run(ctx, runLeaderJobs)
 	})
-	redis.RegisterServer(serverID)
-	redis.StartSignalSubscriber(serverID, deliverToClient)
 	e := echo.New()
+	e.GET("/healthz", handleHealthz)
+	e.GET("/readyz", handleReadyz)
+	e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+	registerGauges()
 	e.GET("/ws", func(c echo.Context) error {
 		handleWebSocket(c.Response(), c.Request())
 		return nil
 	})
 
+	// frontends hosted on another allowed origin call these cross-origin
+	cors := echo.WrapMiddleware(middleware.CORS)
+	preflight := func(c echo.Context) error { return c.NoContent(http.StatusNoContent) }
+
+	e.GET("/session/challenge", func(c echo.Context) error {
+		ch, err := middleware.IssueChallenge(c.Request())
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to issue challenge"})
+		}
+		if ch == nil {
+			ch = map[string]any{"type": "none"}
+		}
+		return c.JSON(http.StatusOK, ch)
+	}, cors)
+
 	e.GET("/session/new", func(c echo.Context) error {
-		token, _, err := middleware.GenerateSessionToken()
+		r, span := tracing.StartHTTP(c.Request(), "session.new")
+		defer span.End()
+		if msg, ok := underMaintenance(r.Context()); ok {
+			span.SetStatus(codes.Error, "maintenance")
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": msg, "code": "maintenance"})
+		}
+		if err := middleware.VerifyChallenge(r); err != nil {
+			span.SetStatus(codes.Error, "challenge failed")
+			return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+		}
+		deviceID := middleware.EnsureDevice(c.Response(), r)
+		session, token, err := middleware.IssueSession(r, map[string]string{"did": deviceID})
 		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "issue failed")
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate session token"})
 		}
-		return c.JSON(http.StatusOK, map[string]any{"token": token})
-	})
+		return c.JSON(http.StatusOK, map[string]any{"token": token, "expires_at": session.ExpiresAt})
+	}, cors)
+	e.POST("/media/upload", handleMediaUpload, cors)
+	e.GET("/media/:key", handleMediaGet)
+	e.POST("/device/reset", handleDeviceReset, cors)
+	for _, path := range []string{"/session/challenge", "/session/new", "/media/upload", "/device/reset"} {
+		e.OPTIONS(path, preflight, cors)
+	}
+	loadOIDC(e, cfg.OIDC)
+	if cfg.Admin.Token != "" {
+		registerAdminRoutes(e)
+	}
 	e.GET("/", func(c echo.Context) error {
 		return c.File("index.html")
 	})
-	go redis.StartMatchmaker()
-	e.Start(":8080")
+
+	go func() {
+		if err := e.Start(fmt.Sprintf(":%d", cfg.Server.Port)); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal("http server failed", "err", err)
+		}
+	}()
+	waitForShutdown(e, flushTraces)
+}
+
+// loadSigningKeys reads the session token keyring from the keys file, or
+// from inline keys ("id:secret,...") and the current key ID.
+func loadSigningKeys(c config.SessionConfig) error {
+	if c.KeysFile != "" {
+		return middleware.LoadSigningKeysFile(c.KeysFile)
+	}
+
+	if c.Keys != "" {
+		keys, err := middleware.ParseSigningKeys(c.Keys)
+		if err != nil {
+			return err
+		}
+		return middleware.SetSigningKeys(keys, c.CurrentKey)
+	}
+
+	return middleware.UseEphemeralKey()
 }
 
-func deliverToClient(userID string, payload json.RawMessage) {
+// loadChallenge picks the gate in front of /session/new.
+func loadChallenge(c config.ChallengeConfig) (middleware.Challenge, error) {
+	switch c.Type {
+	case "none":
+		return nil, nil
+	case "pow":
+		return &middleware.ProofOfWork{
+			Difficulty:    c.PowDifficulty,
+			MaxDifficulty: c.PowMaxDifficulty,
+			PressureStep:  c.PowPressureStep,
+		}, nil
+	case "captcha":
+		return &middleware.Captcha{
+			Provider: c.CaptchaProvider,
+			SiteKey:  c.CaptchaSiteKey,
+			Verifier: &middleware.SiteVerify{
+				URL:    c.CaptchaVerifyURL,
+				Secret: c.CaptchaSecret,
+			},
+		}, nil
+	case "fake-captcha":
+		slog.Warn("using fake captcha, do not use in production")
+		return &middleware.Captcha{
+			Provider: "fake",
+			Verifier: &middleware.FakeCaptcha{Accept: c.CaptchaFakeResponse},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown challenge type %q", c.Type)
+	}
+}
+
+// reloadSigningKeysOnHUP picks up a rotated keyring without a restart.
+func reloadSigningKeysOnHUP(c config.SessionConfig) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if c.KeysFile == "" {
+			continue
+		}
+		if err := loadSigningKeys(c); err != nil {
+			slog.Error("failed to reload session signing keys", "err", err)
+		}
+	}
+}
+
+func deliverToClient(ctx context.Context, userID string, payload json.RawMessage) {
+	if userID == "" {
+		handleServerSignal(ctx, payload)
+		return
+	}
+
 	clientsMu.RLock()
 	client := clients[userID]
 	clientsMu.RUnlock()
@@ -76,8 +298,5 @@ func deliverToClient(userID string, payload json.RawMessage) {
 		return
 	}
 
-	client.Send <- SendMessageType{
-		Type:    websocket.TextMessage,
-		Message: payload,
-	}
+	client.enqueue(payload)
 }
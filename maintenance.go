@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"omiro/redis"
+)
+
+const defaultMaintenanceMessage = "Omiro is down for maintenance, please try again later"
+
+// underMaintenance reports whether new sessions and matches are on hold,
+// and the message to show. If Redis can't say, work goes ahead.
+func underMaintenance(ctx context.Context) (string, bool) {
+	m, err := redis.GetMaintenance(ctx)
+	if err != nil {
+		slog.Warn("failed to read maintenance flag", "err", err)
+		return "", false
+	}
+	if !m.Enabled {
+		return "", false
+	}
+	if m.Message == "" {
+		return defaultMaintenanceMessage, true
+	}
+	return m.Message, true
+}
+
+// announcementMessage is the op a client receives for a.
+func announcementMessage(a redis.Announcement) map[string]any {
+	msg := map[string]any{
+		"op":       "announcement",
+		"message":  a.Message,
+		"severity": a.Severity,
+	}
+	if a.ExpiresAt != 0 {
+		msg["expires_at"] = a.ExpiresAt
+	}
+	return msg
+}
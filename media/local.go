@@ -0,0 +1,102 @@
+package media
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var keyRe = regexp.MustCompile(`^[a-zA-Z0-9-]+\.[a-z]+$`)
+
+var ErrNotFound = errors.New("media not found")
+
+// Local keeps files on disk and serves them through signed URLs that the
+// HTTP server checks with Verify. Files older than ttl are deleted.
+type Local struct {
+	dir     string
+	baseURL string
+	secret  []byte
+	ttl     time.Duration
+}
+
+func NewLocal(dir, baseURL string, secret []byte, ttl time.Duration) (*Local, error) {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "omiro-media")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	l := &Local{dir: dir, baseURL: baseURL, secret: secret, ttl: ttl}
+	go l.janitor()
+	return l, nil
+}
+
+func (l *Local) Put(key, contentType string, data []byte) error {
+	if !keyRe.MatchString(key) {
+		return fmt.Errorf("invalid media key %q", key)
+	}
+	return os.WriteFile(filepath.Join(l.dir, key), data, 0o600)
+}
+
+func (l *Local) URL(key string, ttl time.Duration) (string, error) {
+	exp := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	q := url.Values{}
+	q.Set("exp", exp)
+	q.Set("sig", l.sign(key, exp))
+	return fmt.Sprintf("%s/media/%s?%s", l.baseURL, key, q.Encode()), nil
+}
+
+// Verify checks a signed URL and returns the file path to serve.
+func (l *Local) Verify(key, exp, sig string) (string, error) {
+	if !keyRe.MatchString(key) {
+		return "", ErrNotFound
+	}
+	if !hmac.Equal([]byte(l.sign(key, exp)), []byte(sig)) {
+		return "", ErrNotFound
+	}
+	expUnix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > expUnix {
+		return "", ErrNotFound
+	}
+
+	path := filepath.Join(l.dir, key)
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) > l.ttl {
+		return "", ErrNotFound
+	}
+	return path, nil
+}
+
+func (l *Local) sign(key, exp string) string {
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(key + ":" + exp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (l *Local) janitor() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		entries, err := os.ReadDir(l.dir)
+		if err != nil {
+			slog.Error("media janitor failed", "err", err)
+			continue
+		}
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || time.Since(info.ModTime()) <= l.ttl {
+				continue
+			}
+			os.Remove(filepath.Join(l.dir, e.Name()))
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported media type")
+	ErrTooLarge        = errors.New("media too large")
+	ErrInvalidImage    = errors.New("invalid image")
+)
+
+// limits that guard the decoder against decompression bombs
+const (
+	maxPixels    = 4096 * 4096
+	maxGIFFrames = 200
+	// every GIF frame decodes to an image up to the logical screen size, so
+	// an animation is also capped on frames times screen size
+	maxGIFPixels = 64 << 20
+)
+
+var extensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// Store keeps uploaded files for a short time and hands out expiring URLs.
+type Store interface {
+	Put(key, contentType string, data []byte) error
+	URL(key string, ttl time.Duration) (string, error)
+}
+
+// Sanitize checks the real content type of data and re-encodes the image,
+// which drops EXIF and any other metadata or trailing payload.
+func Sanitize(data []byte, maxBytes int64) ([]byte, string, error) {
+	if int64(len(data)) > maxBytes {
+		return nil, "", ErrTooLarge
+	}
+
+	contentType := http.DetectContentType(data)
+	if _, ok := extensions[contentType]; !ok {
+		return nil, "", ErrUnsupportedType
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", ErrInvalidImage
+	}
+	if "image/"+format != contentType {
+		return nil, "", ErrInvalidImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxPixels {
+		return nil, "", ErrTooLarge
+	}
+
+	var out bytes.Buffer
+	switch contentType {
+	case "image/jpeg":
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", ErrInvalidImage
+		}
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: 90})
+		if err != nil {
+			return nil, "", err
+		}
+	case "image/png":
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", ErrInvalidImage
+		}
+		if err := png.Encode(&out, img); err != nil {
+			return nil, "", err
+		}
+	case "image/gif":
+		frames, err := gifFrames(data, maxGIFFrames)
+		if err != nil {
+			return nil, "", ErrInvalidImage
+		}
+		if frames > maxGIFFrames || frames*cfg.Width*cfg.Height > maxGIFPixels {
+			return nil, "", ErrTooLarge
+		}
+		img, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", ErrInvalidImage
+		}
+		if len(img.Image) > maxGIFFrames {
+			return nil, "", ErrTooLarge
+		}
+		if err := gif.EncodeAll(&out, img); err != nil {
+			return nil, "", err
+		}
+	}
+
+	return out.Bytes(), contentType, nil
+}
+
+// gifFrames counts the frames of a GIF by walking its blocks, without
+// decoding any image data. It stops counting once it has seen more than
+// limit.
+func gifFrames(data []byte, limit int) (int, error) {
+	// header and logical screen descriptor
+	if len(data) < 13 {
+		return 0, ErrInvalidImage
+	}
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&0x07 + 1)
+	}
+
+	// skipSubBlocks moves pos past a chain of data sub-blocks
+	skipSubBlocks := func() error {
+		for {
+			if pos >= len(data) {
+				return ErrInvalidImage
+			}
+			n := int(data[pos])
+			pos += 1 + n
+			if n == 0 {
+				return nil
+			}
+		}
+	}
+
+	frames := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension: label, then sub-blocks
+			pos += 2
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+		case 0x2c: // image descriptor, optional local color table, LZW size, sub-blocks
+			if pos+10 > len(data) {
+				return 0, ErrInvalidImage
+			}
+			packed := data[pos+9]
+			pos += 10
+			if packed&0x80 != 0 {
+				pos += 3 << (packed&0x07 + 1)
+			}
+			pos++
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+			frames++
+			if frames > limit {
+				return frames, nil
+			}
+		case 0x3b: // trailer
+			return frames, nil
+		default:
+			return 0, ErrInvalidImage
+		}
+	}
+	return 0, ErrInvalidImage
+}
+
+func Extension(contentType string) string {
+	return extensions[contentType]
+}
+
+/********************************
+ * CONFIG
+ ********************************/
+
+type Config struct {
+	Backend string // "local" or "s3"
+	Secret  []byte
+
+	Dir     string
+	BaseURL string
+	TTL     time.Duration
+
+	S3 S3Config
+}
+
+func New(cfg Config) (Store, error) {
+	switch cfg.Backend {
+	case "", "local":
+		return NewLocal(cfg.Dir, cfg.BaseURL, cfg.Secret, cfg.TTL)
+	case "s3":
+		return NewS3(cfg.S3), nil
+	}
+	return nil, fmt.Errorf("unknown media backend %q", cfg.Backend)
+}
@@ -0,0 +1,89 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+// makeGIF encodes an animation of frames w×h frames on a screen×screen
+// logical screen.
+func makeGIF(t *testing.T, frames, w, h, screen int) []byte {
+	t.Helper()
+	pal := color.Palette{color.Black, color.White}
+	g := &gif.GIF{Config: image.Config{ColorModel: pal, Width: screen, Height: screen}}
+	for range frames {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, w, h), pal))
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSanitizeGIFLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"small animation", makeGIF(t, 3, 16, 16, 16), nil},
+		{"frame limit", makeGIF(t, maxGIFFrames, 1, 1, 1), nil},
+		{"too many frames", makeGIF(t, maxGIFFrames+1, 1, 1, 1), ErrTooLarge},
+		// tiny frames, but each would decode to a 4096x4096 canvas
+		{"frames times screen", makeGIF(t, 5, 1, 1, 4096), ErrTooLarge},
+		{"truncated", makeGIF(t, 3, 16, 16, 16)[:40], ErrInvalidImage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, contentType, err := Sanitize(tt.data, 10<<20)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Sanitize() = %v, want %v", err, tt.want)
+			}
+			if err == nil && contentType != "image/gif" {
+				t.Fatalf("content type %q", contentType)
+			}
+		})
+	}
+}
+
+func TestGIFFramesMatchesDecoder(t *testing.T) {
+	for _, n := range []int{1, 2, 17} {
+		data := makeGIF(t, n, 8, 8, 8)
+		got, err := gifFrames(data, maxGIFFrames)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != len(g.Image) {
+			t.Fatalf("gifFrames() = %d, decoder found %d", got, len(g.Image))
+		}
+	}
+}
+
+func TestGIFFramesLocalColorTables(t *testing.T) {
+	pals := []color.Palette{
+		{color.Black, color.White},
+		{color.Black, color.White, color.Gray{0x80}, color.Gray{0x40}},
+	}
+	g := &gif.GIF{}
+	for i := range 6 {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), pals[i%2]))
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := gifFrames(buf.Bytes(), maxGIFFrames); err != nil || got != 6 {
+		t.Fatalf("gifFrames() = %d, %v, want 6", got, err)
+	}
+}
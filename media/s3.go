@@ -0,0 +1,181 @@
+package media
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config points at any S3-compatible bucket (AWS, MinIO, R2, ...). Expiry
+// of stored objects should be handled by a bucket lifecycle rule; the
+// presigned URLs handed to clients expire on their own.
+type S3Config struct {
+	Endpoint  string // e.g. https://s3.eu-west-1.amazonaws.com
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+}
+
+type S3 struct {
+	cfg    S3Config
+	client *http.Client
+}
+
+func NewS3(cfg S3Config) *S3 {
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+	return &S3{cfg: cfg, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (s *S3) Put(key, contentType string, data []byte) error {
+	u := s.objectURL(key)
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	payloadHash := sha256Hex(data)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+
+	headers := map[string]string{
+		"content-type":         contentType,
+		"host":                 u.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           now.Format("20060102T150405Z"),
+	}
+	signed, sig := s.signature(http.MethodPut, u, "", headers, payloadHash, now)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, s.scope(now), signed, sig,
+	))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("s3 put %s: %s: %s", key, resp.Status, body)
+	}
+	return nil
+}
+
+// URL returns a presigned GET URL valid for ttl.
+func (s *S3) URL(key string, ttl time.Duration) (string, error) {
+	u := s.objectURL(key)
+	now := time.Now().UTC()
+
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", s.cfg.AccessKey+"/"+s.scope(now))
+	q.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(ttl.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+	query := canonicalQuery(q)
+
+	_, sig := s.signature(http.MethodGet, u, query, map[string]string{"host": u.Host}, "UNSIGNED-PAYLOAD", now)
+	u.RawQuery = query + "&X-Amz-Signature=" + sig
+	return u.String(), nil
+}
+
+func (s *S3) objectURL(key string) *url.URL {
+	u, _ := url.Parse(s.cfg.Endpoint)
+	if s.cfg.PathStyle {
+		u.Path = "/" + s.cfg.Bucket + "/" + key
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	return u
+}
+
+func (s *S3) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+// signature implements AWS Signature Version 4 and returns the signed
+// header list alongside the hex signature.
+func (s *S3) signature(method string, u *url.URL, query string, headers map[string]string, payloadHash string, t time.Time) (string, string) {
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		query,
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		t.Format("20060102T150405Z"),
+		s.scope(t),
+		sha256Hex([]byte(canonical)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), t.Format("20060102"))
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	return signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, awsEscape(k)+"="+awsEscape(q.Get(k)))
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes everything except RFC 3986 unreserved characters.
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,94 @@
+// Package metrics defines the Prometheus metrics served on /metrics.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	Matches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "omiro_matches_total",
+		Help: "Pairs made, by agreed mode.",
+	}, []string{"mode"})
+
+	Nexts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "omiro_nexts_total",
+		Help: "Times a client skipped to the next partner.",
+	})
+
+	Disconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "omiro_disconnects_total",
+		Help: "Closed WebSocket connections, by reason.",
+	}, []string{"reason"})
+
+	ChatMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "omiro_chat_messages_total",
+		Help: "Chat messages, by kind (text, media) and result (delivered, blocked).",
+	}, []string{"kind", "result"})
+
+	SignalingMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "omiro_signaling_messages_total",
+		Help: "WebRTC signaling messages relayed, by op.",
+	}, []string{"op"})
+
+	RejectedHandshakes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "omiro_rejected_handshakes_total",
+		Help: "WebSocket handshakes refused, by reason.",
+	}, []string{"reason"})
+
+	SendDrops = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "omiro_send_drops_total",
+		Help: "Outgoing messages dropped because a client's send queue was full.",
+	})
+
+	QueueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "omiro_queue_wait_seconds",
+		Help:    "Time from joining the queue to being matched, by requested mode.",
+		Buckets: []float64{0.5, 1, 2, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"mode"})
+
+	ReapedServers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "omiro_reaped_servers_total",
+		Help: "Dead servers cleaned up by the reaper.",
+	})
+
+	ReapedClients = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "omiro_reaped_clients_total",
+		Help: "Clients of dead servers removed by the reaper.",
+	})
+
+	CallDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "omiro_call_duration_seconds",
+		Help:    "How long pairs stayed together.",
+		Buckets: []float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+	})
+)
+
+// RegisterGauges exposes live server state. The functions are called at
+// scrape time, so they must be cheap and safe to call concurrently.
+func RegisterGauges(clients, queue, pairs, leader func() float64) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "omiro_connected_clients",
+		Help: "WebSocket clients connected to this server.",
+	}, clients)
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "omiro_queue_length",
+		Help: "Clients waiting for a match on this server.",
+	}, queue)
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "omiro_active_pairs",
+		Help: "Matched pairs on this server.",
+	}, pairs)
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "omiro_leader",
+		Help: "1 if this server holds the lease for singleton jobs.",
+	}, leader)
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"omiro/helper"
+	"strings"
+	"time"
+)
+
+// CaptchaVerifier checks a CAPTCHA response token with its provider.
+type CaptchaVerifier interface {
+	Verify(ctx context.Context, response, remoteIP string) (bool, error)
+}
+
+// Captcha is a Challenge backed by an external CAPTCHA provider. The client
+// renders the provider widget with SiteKey and sends the resulting token as
+// the "captcha" query parameter or X-Captcha-Response header.
+type Captcha struct {
+	Provider string
+	SiteKey  string
+	Verifier CaptchaVerifier
+}
+
+func (c *Captcha) Name() string { return "captcha" }
+
+func (c *Captcha) Issue(r *http.Request) (map[string]any, error) {
+	return map[string]any{
+		"provider": c.Provider,
+		"site_key": c.SiteKey,
+	}, nil
+}
+
+func (c *Captcha) Verify(r *http.Request) error {
+	response := challengeParam(r, "captcha", "X-Captcha-Response")
+	if response == "" {
+		return ErrChallengeRequired
+	}
+
+	ok, err := c.Verifier.Verify(r.Context(), response, helper.GetRealIP(r))
+	if err != nil {
+		slog.Error("captcha verify error", "err", err)
+		return ErrChallengeFailed
+	}
+	if !ok {
+		return ErrChallengeFailed
+	}
+	return nil
+}
+
+// SiteVerify talks to the "siteverify" endpoint shared by reCAPTCHA,
+// hCaptcha and Cloudflare Turnstile.
+type SiteVerify struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+func (s *SiteVerify) Verify(ctx context.Context, response, remoteIP string) (bool, error) {
+	form := url.Values{}
+	form.Set("secret", s.Secret)
+	form.Set("response", response)
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
+
+// FakeCaptcha accepts exactly one response string. It stands in for a real
+// provider in local development and tests.
+type FakeCaptcha struct {
+	Accept string
+}
+
+func (f *FakeCaptcha) Verify(ctx context.Context, response, remoteIP string) (bool, error) {
+	return response == f.Accept, nil
+}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+)
+
+var (
+	ErrChallengeRequired = errors.New("challenge required")
+	ErrChallengeFailed   = errors.New("challenge failed")
+)
+
+// Challenge gates /session/new. Issue describes what the client has to do,
+// and Verify checks the answer the client sends back with its token request.
+type Challenge interface {
+	Name() string
+	Issue(r *http.Request) (map[string]any, error)
+	Verify(r *http.Request) error
+}
+
+var activeChallenge Challenge
+
+func SetChallenge(c Challenge) {
+	activeChallenge = c
+}
+
+// IssueChallenge returns the challenge a client must solve before asking for
+// a session token, or nil when no challenge is configured.
+func IssueChallenge(r *http.Request) (map[string]any, error) {
+	if activeChallenge == nil {
+		return nil, nil
+	}
+	ch, err := activeChallenge.Issue(r)
+	if err != nil {
+		return nil, err
+	}
+	ch["type"] = activeChallenge.Name()
+	return ch, nil
+}
+
+func VerifyChallenge(r *http.Request) error {
+	if activeChallenge == nil {
+		return nil
+	}
+	return activeChallenge.Verify(r)
+}
@@ -0,0 +1,183 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"omiro/redis"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// setupChallenges points the redis package at a fresh miniredis and installs
+// a fixed signing key.
+func setupChallenges(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	m := miniredis.RunT(t)
+	if err := redis.Init(redis.Config{Host: m.Host(), Port: m.Port()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSigningKeys([]SigningKey{{ID: "test", Secret: "test-secret"}}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetChallenge(nil) })
+	return m
+}
+
+// powChallenge builds a challenge the way ProofOfWork.Issue does, but with a
+// chosen expiry and difficulty.
+func powChallenge(exp time.Time, difficulty int) string {
+	kid, secret := currentSigningKey()
+	nonce := strconv.FormatInt(time.Now().UnixNano(), 16)
+	msg := fmt.Sprintf("pow:%s:%s:%d:%d", kid, nonce, exp.Unix(), difficulty)
+	return fmt.Sprintf("%s:%s:%d:%d:%s", kid, nonce, exp.Unix(), difficulty, signToken(secret, msg))
+}
+
+// solvePoW returns the first solution that meets difficulty, or with valid
+// false, the first one that doesn't.
+func solvePoW(challenge string, difficulty int, valid bool) string {
+	for i := 0; ; i++ {
+		s := strconv.Itoa(i)
+		sum := sha256.Sum256([]byte(challenge + ":" + s))
+		if (leadingZeroBits(sum[:]) >= difficulty) == valid {
+			return s
+		}
+	}
+}
+
+func challengeRequest(params url.Values) *http.Request {
+	return httptest.NewRequest(http.MethodGet, "/session/new?"+params.Encode(), nil)
+}
+
+func TestProofOfWorkVerify(t *testing.T) {
+	setupChallenges(t)
+	pow := &ProofOfWork{Difficulty: 8, MaxDifficulty: 8}
+	SetChallenge(pow)
+
+	valid := powChallenge(time.Now().Add(time.Minute), 8)
+	expired := powChallenge(time.Now().Add(-time.Second), 8)
+	easier := powChallenge(time.Now().Add(time.Minute), 8)
+	easier = strings.Replace(easier, ":8:", ":0:", 1)
+	forged := powChallenge(time.Now().Add(time.Minute), 8)
+	forged = forged[:strings.LastIndex(forged, ":")+1] + strings.Repeat("0", 64)
+
+	tests := []struct {
+		name      string
+		challenge string
+		solution  string
+		want      error
+	}{
+		{"valid", valid, solvePoW(valid, 8, true), nil},
+		{"wrong solution", valid, solvePoW(valid, 8, false), ErrChallengeFailed},
+		{"expired", expired, solvePoW(expired, 8, true), ErrChallengeFailed},
+		{"lowered difficulty", easier, "0", ErrChallengeFailed},
+		{"bad signature", forged, solvePoW(forged, 8, true), ErrChallengeFailed},
+		{"malformed", "nope", "0", ErrChallengeFailed},
+		{"missing solution", valid, "", ErrChallengeRequired},
+		{"missing challenge", "", "0", ErrChallengeRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := challengeRequest(url.Values{"challenge": {tt.challenge}, "solution": {tt.solution}})
+			if err := VerifyChallenge(r); !errors.Is(err, tt.want) {
+				t.Fatalf("VerifyChallenge() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestProofOfWorkRejectsReplay(t *testing.T) {
+	setupChallenges(t)
+	SetChallenge(&ProofOfWork{Difficulty: 4, MaxDifficulty: 4})
+
+	ch, err := IssueChallenge(httptest.NewRequest(http.MethodGet, "/session/challenge", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := ch["challenge"].(string)
+	params := url.Values{"challenge": {challenge}, "solution": {solvePoW(challenge, 4, true)}}
+
+	if err := VerifyChallenge(challengeRequest(params)); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := VerifyChallenge(challengeRequest(params)); !errors.Is(err, ErrChallengeFailed) {
+		t.Fatalf("replay: got %v, want %v", err, ErrChallengeFailed)
+	}
+}
+
+func TestProofOfWorkDifficulty(t *testing.T) {
+	tests := []struct {
+		name string
+		pow  ProofOfWork
+		hits int
+		want int
+	}{
+		{"no pressure", ProofOfWork{Difficulty: 4, MaxDifficulty: 8, PressureStep: 10}, 0, 4},
+		{"below a step", ProofOfWork{Difficulty: 4, MaxDifficulty: 8, PressureStep: 10}, 9, 4},
+		{"one step", ProofOfWork{Difficulty: 4, MaxDifficulty: 8, PressureStep: 10}, 10, 5},
+		{"several steps", ProofOfWork{Difficulty: 4, MaxDifficulty: 8, PressureStep: 10}, 35, 7},
+		{"capped", ProofOfWork{Difficulty: 4, MaxDifficulty: 8, PressureStep: 10}, 200, 8},
+		{"pressure disabled", ProofOfWork{Difficulty: 4, MaxDifficulty: 8}, 200, 4},
+		{"no headroom", ProofOfWork{Difficulty: 8, MaxDifficulty: 8, PressureStep: 10}, 200, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupChallenges(t)
+			for range tt.hits {
+				if err := redis.RecordRateLimitHit(redis.Ctx, "handshake"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ch, err := tt.pow.Issue(httptest.NewRequest(http.MethodGet, "/session/challenge", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ch["difficulty"].(int); got != tt.want {
+				t.Fatalf("difficulty = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFakeCaptchaVerify(t *testing.T) {
+	setupChallenges(t)
+	SetChallenge(&Captcha{Provider: "fake", Verifier: &FakeCaptcha{Accept: "pass"}})
+
+	tests := []struct {
+		name   string
+		query  string
+		header string
+		want   error
+	}{
+		{"accepted", "pass", "", nil},
+		{"accepted from header", "", "pass", nil},
+		{"rejected", "fail", "", ErrChallengeFailed},
+		{"missing", "", "", ErrChallengeRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := challengeRequest(url.Values{"captcha": {tt.query}})
+			if tt.header != "" {
+				r.Header.Set("X-Captcha-Response", tt.header)
+			}
+			if err := VerifyChallenge(r); !errors.Is(err, tt.want) {
+				t.Fatalf("VerifyChallenge() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNoChallenge(t *testing.T) {
+	SetChallenge(nil)
+	if err := VerifyChallenge(challengeRequest(nil)); err != nil {
+		t.Fatalf("VerifyChallenge() = %v, want nil", err)
+	}
+}
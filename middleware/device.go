@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The device cookie gives anonymous users a stable ID that survives IP
+// changes. It outlives any session token by far, so it is signed with its
+// own key rather than the session keyring: rotating session keys must not
+// reset every device ID, and with it every device ban.
+const (
+	DeviceCookie = "omiro_device"
+	deviceMaxAge = 365 * 24 * time.Hour
+)
+
+var (
+	deviceKeyMu sync.RWMutex
+	deviceKey   []byte
+)
+
+// SetDeviceKey sets the secret device cookies are signed with. It should
+// never change; cookies signed with another key are replaced by new IDs.
+func SetDeviceKey(key string) {
+	deviceKeyMu.Lock()
+	deviceKey = []byte(key)
+	deviceKeyMu.Unlock()
+}
+
+// UseEphemeralDeviceKey installs a random device key. Device IDs then only
+// verify on this process until it restarts.
+func UseEphemeralDeviceKey() {
+	b := make([]byte, 32)
+	rand.Read(b)
+	deviceKeyMu.Lock()
+	deviceKey = b
+	deviceKeyMu.Unlock()
+	slog.Warn("no device key configured, using a random key; device IDs won't survive a restart")
+}
+
+func currentDeviceKey() []byte {
+	deviceKeyMu.RLock()
+	defer deviceKeyMu.RUnlock()
+	return deviceKey
+}
+
+// DeviceID returns the verified device ID from r's cookie, or "".
+func DeviceID(r *http.Request) string {
+	cookie, err := r.Cookie(DeviceCookie)
+	if err != nil {
+		return ""
+	}
+
+	id, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return ""
+	}
+	secret := currentDeviceKey()
+	if secret == nil || !hmac.Equal([]byte(signToken(secret, "device:"+id)), []byte(sig)) {
+		return ""
+	}
+	return id
+}
+
+// EnsureDevice returns the caller's device ID, issuing a new cookie if the
+// request has none or an invalid one. The cookie is re-sent every time to
+// keep it from expiring.
+func EnsureDevice(w http.ResponseWriter, r *http.Request) string {
+	id := DeviceID(r)
+	if id == "" {
+		id = uuid.NewString()
+	}
+	setDeviceCookie(w, r, id)
+	return id
+}
+
+// ResetDevice throws away the caller's device ID and issues a fresh one.
+func ResetDevice(w http.ResponseWriter, r *http.Request) string {
+	id := uuid.NewString()
+	setDeviceCookie(w, r, id)
+	return id
+}
+
+func setDeviceCookie(w http.ResponseWriter, r *http.Request, id string) {
+	secret := currentDeviceKey()
+	if secret == nil {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     DeviceCookie,
+		Value:    id + "." + signToken(secret, "device:"+id),
+		Path:     "/",
+		MaxAge:   int(deviceMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
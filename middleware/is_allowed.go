@@ -1,47 +1,88 @@
 package middleware
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"net/http"
 	"omiro/helper"
+	"omiro/metrics"
 	"omiro/redis"
 	"time"
 )
 
-func AllowHandshake(ip string, limit int) (bool, error) {
-	allowed, err := redis.CheckRateLimit(ip, limit, 1*time.Minute)
+// handshakeLimit is the number of WebSocket handshakes allowed per IP per
+// minute.
+var handshakeLimit = 60
+
+func SetHandshakeLimit(n int) {
+	handshakeLimit = n
+}
+
+func AllowHandshake(ctx context.Context, ip string, limit int) (bool, error) {
+	allowed, err := redis.CheckRateLimit(ctx, ip, limit, 1*time.Minute)
 	if err != nil {
 		return false, err
 	}
 	return allowed, nil
 }
 
-func EnsureUpgradeChecks(w http.ResponseWriter, r *http.Request) bool {
-
-	origin := r.Header.Get("Origin")
-	// TODO: Add allowed origins
-	if origin != "http://localhost:8080" && origin != "https://omiro.underthedesk.blog" {
+// EnsureUpgradeChecks runs origin, rate limit and session checks before a
+// WebSocket upgrade and returns the caller's session.
+func EnsureUpgradeChecks(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	if !CheckOrigin(r) {
+		metrics.RejectedHandshakes.WithLabelValues("origin").Inc()
 		http.Error(w, "Forbidden origin", http.StatusForbidden)
-		return false
+		return nil, false
 	}
 
 	ip := helper.GetRealIP(r)
-	log.Printf("IP: %s", ip)
-	ok, err := AllowHandshake(ip, 60)
+	ok, err := AllowHandshake(r.Context(), ip, handshakeLimit)
+	if err == nil && !ok {
+		redis.RecordRateLimitHit(r.Context(), "handshake")
+	}
 	if err != nil || !ok {
+		metrics.RejectedHandshakes.WithLabelValues("rate_limited").Inc()
 		http.Error(w, "Too many requests", http.StatusTooManyRequests)
-		return false
+		return nil, false
 	}
 
-	token := r.URL.Query().Get("token")
-	if token == "" {
-		token = r.Header.Get("X-Session-Token")
-	}
-	log.Printf("Token: %s", token)
-	if !VerifySessionToken(token) {
+	token := TokenFromRequest(r)
+	session, err := ConsumeSession(token, r)
+	if err != nil {
+		slog.Info("handshake rejected", "reason", "unauthorized", "ip", ip, "err", err)
+		metrics.RejectedHandshakes.WithLabelValues("unauthorized").Inc()
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return false
+		return nil, false
+	}
+
+	if banned, reason := IsBanned(r.Context(), session, ip); banned {
+		slog.Info("handshake rejected", "reason", "banned", "ip", ip, "ban_reason", reason)
+		metrics.RejectedHandshakes.WithLabelValues("banned").Inc()
+		http.Error(w, "Banned", http.StatusForbidden)
+		return nil, false
+	}
+	return session, true
+}
+
+// IsBanned checks the ban list under the session's user ID when logged in,
+// and under ip for anonymous sessions. Device bans apply to both.
+func IsBanned(ctx context.Context, session *Session, ip string) (bool, string) {
+	var banned bool
+	var reason string
+	var err error
+	if uid := session.UserID(); uid != "" {
+		banned, reason, err = redis.IsUserBanned(ctx, uid)
+	} else {
+		banned, reason, err = redis.IsIPBanned(ctx, ip)
+	}
+	if err == nil && !banned {
+		if did := session.DeviceID(); did != "" {
+			banned, reason, err = redis.IsDeviceBanned(ctx, did)
+		}
+	}
+	if err != nil {
+		slog.Error("ban check failed", "err", err)
+		return false, ""
 	}
-	log.Printf("Token verified")
-	return true
+	return banned, reason
 }
@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SigningKey is one HMAC secret used for session tokens. Retired keys are
+// kept in the file for reference but no longer verify anything.
+type SigningKey struct {
+	ID      string `json:"id"`
+	Secret  string `json:"secret"`
+	Retired bool   `json:"retired,omitempty"`
+}
+
+type keyFile struct {
+	Current string       `json:"current"`
+	Keys    []SigningKey `json:"keys"`
+}
+
+var (
+	keysMu      sync.RWMutex
+	signingKeys = map[string][]byte{}
+	currentKey  string
+)
+
+// SetSigningKeys replaces the active keyring. New tokens are signed with
+// current; tokens signed by any other non-retired key still verify.
+func SetSigningKeys(keys []SigningKey, current string) error {
+	active := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		if k.ID == "" || k.Secret == "" {
+			return errors.New("signing key needs an id and a secret")
+		}
+		if strings.ContainsAny(k.ID, ":.") {
+			return fmt.Errorf("signing key id %q must not contain ':' or '.'", k.ID)
+		}
+		if _, dup := active[k.ID]; dup {
+			return fmt.Errorf("duplicate signing key id %q", k.ID)
+		}
+		if !k.Retired {
+			active[k.ID] = []byte(k.Secret)
+		}
+	}
+
+	if current == "" && len(keys) > 0 {
+		current = keys[0].ID
+	}
+	if _, ok := active[current]; !ok {
+		return fmt.Errorf("current signing key %q is missing or retired", current)
+	}
+
+	keysMu.Lock()
+	signingKeys = active
+	currentKey = current
+	keysMu.Unlock()
+
+	slog.Info("session signing keys loaded", "active", len(active), "current", current)
+	return nil
+}
+
+// LoadSigningKeysFile reads a JSON keyring:
+//
+//	{"current": "2024-06", "keys": [{"id": "2024-06", "secret": "..."}, {"id": "2024-01", "secret": "...", "retired": true}]}
+func LoadSigningKeysFile(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var f keyFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return SetSigningKeys(f.Keys, f.Current)
+}
+
+// ParseSigningKeys reads "id:secret,id:secret" as used by SESSION_KEYS.
+func ParseSigningKeys(spec string) ([]SigningKey, error) {
+	var keys []SigningKey
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("signing key %q must be id:secret", item)
+		}
+		keys = append(keys, SigningKey{ID: id, Secret: secret})
+	}
+	return keys, nil
+}
+
+// UseEphemeralKey installs a random key. Tokens signed with it only verify on
+// this process, so it is only suitable for single-server development.
+func UseEphemeralKey() error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	if err := SetSigningKeys([]SigningKey{{ID: "ephemeral", Secret: hex.EncodeToString(b)}}, "ephemeral"); err != nil {
+		return err
+	}
+	slog.Warn("no session signing keys configured, using a random key; tokens won't verify on other servers")
+	return nil
+}
+
+func currentSigningKey() (string, []byte) {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	return currentKey, signingKeys[currentKey]
+}
+
+func lookupSigningKey(id string) ([]byte, bool) {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	k, ok := signingKeys[id]
+	return k, ok
+}
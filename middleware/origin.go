@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// OriginPolicy decides which browser origins may open a WebSocket or call the
+// session endpoints. Same-origin requests are always allowed.
+type OriginPolicy struct {
+	// Allowed holds exact origins ("https://chat.example.com"), wildcard
+	// subdomains ("https://*.example.com") or "*" for any origin.
+	Allowed []string
+	// AllowLocalhost lets localhost and loopback addresses in on any port,
+	// for development.
+	AllowLocalhost bool
+}
+
+type originPattern struct {
+	any    bool
+	scheme string
+	host   string // host[:port], or the suffix after "*." for wildcards
+	suffix bool
+}
+
+var (
+	originMu       sync.RWMutex
+	originPatterns []originPattern
+	originLocal    bool
+)
+
+func SetOriginPolicy(p OriginPolicy) error {
+	var patterns []originPattern
+	for _, raw := range p.Allowed {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		if raw == "*" {
+			patterns = append(patterns, originPattern{any: true})
+			continue
+		}
+
+		scheme, host, ok := strings.Cut(strings.ToLower(strings.TrimSuffix(raw, "/")), "://")
+		if !ok || scheme == "" || host == "" || strings.ContainsAny(host, "/?#") {
+			return fmt.Errorf("invalid allowed origin %q", raw)
+		}
+		pat := originPattern{scheme: scheme, host: host}
+		if rest, ok := strings.CutPrefix(host, "*."); ok {
+			pat.host, pat.suffix = rest, true
+		}
+		if strings.Contains(pat.host, "*") {
+			return fmt.Errorf("invalid allowed origin %q: only a leading *. is supported", raw)
+		}
+		patterns = append(patterns, pat)
+	}
+
+	originMu.Lock()
+	originPatterns = patterns
+	originLocal = p.AllowLocalhost
+	originMu.Unlock()
+	return nil
+}
+
+// CheckOrigin reports whether r's Origin is allowed. Requests without an
+// Origin header don't come from a browser page and are let through; the
+// session token still has to check out.
+func CheckOrigin(r *http.Request) bool {
+	if r.Header.Get("Origin") == "" {
+		return true
+	}
+	ok, _ := matchOrigin(r)
+	return ok
+}
+
+// matchOrigin reports whether r's Origin is allowed, and whether it was only
+// let in by a "*" pattern rather than one naming it.
+func matchOrigin(r *http.Request) (ok, wildcard bool) {
+	u, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil || u.Host == "" {
+		return false, false
+	}
+	scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+
+	if host == strings.ToLower(r.Host) {
+		return true, false
+	}
+
+	originMu.RLock()
+	defer originMu.RUnlock()
+
+	if originLocal && isLocalhost(u.Hostname()) {
+		return true, false
+	}
+	for _, p := range originPatterns {
+		if p.any {
+			wildcard = true
+			continue
+		}
+		if p.scheme != scheme {
+			continue
+		}
+		if p.suffix {
+			if strings.HasSuffix(host, "."+p.host) {
+				return true, false
+			}
+		} else if host == p.host {
+			return true, false
+		}
+	}
+	return wildcard, wildcard
+}
+
+// CORS answers cross-origin requests from allowed origins, including
+// preflights, and lets the device cookie travel with them. Origins only
+// allowed by "*" get no credentials, so any site can call the endpoints but
+// not with the visitor's cookies.
+func CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		ok, wildcard := matchOrigin(r)
+		if !ok {
+			http.Error(w, "Forbidden origin", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if !wildcard {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			if h := r.Header.Get("Access-Control-Request-Headers"); h != "" {
+				w.Header().Set("Access-Control-Allow-Headers", h)
+			}
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isLocalhost(host string) bool {
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	t.Cleanup(func() { SetOriginPolicy(OriginPolicy{}) })
+
+	tests := []struct {
+		name        string
+		allowed     []string
+		origin      string
+		method      string
+		status      int
+		credentials bool
+	}{
+		{"no origin", []string{"https://chat.example.com"}, "", http.MethodPost, http.StatusOK, false},
+		{"same origin", nil, "https://omiro.test", http.MethodPost, http.StatusOK, true},
+		{"exact match", []string{"https://chat.example.com"}, "https://chat.example.com", http.MethodPost, http.StatusOK, true},
+		{"exact match, other scheme", []string{"https://chat.example.com"}, "http://chat.example.com", http.MethodPost, http.StatusForbidden, false},
+		{"not listed", []string{"https://chat.example.com"}, "https://evil.example.net", http.MethodPost, http.StatusForbidden, false},
+		{"subdomain wildcard", []string{"https://*.example.com"}, "https://a.example.com", http.MethodPost, http.StatusOK, true},
+		{"subdomain wildcard, apex", []string{"https://*.example.com"}, "https://example.com", http.MethodPost, http.StatusForbidden, false},
+		{"wildcard", []string{"*"}, "https://evil.example.net", http.MethodPost, http.StatusOK, false},
+		{"wildcard preflight", []string{"*"}, "https://evil.example.net", http.MethodOptions, http.StatusNoContent, false},
+		{"wildcard and exact match", []string{"*", "https://chat.example.com"}, "https://chat.example.com", http.MethodPost, http.StatusOK, true},
+		{"exact match preflight", []string{"https://chat.example.com"}, "https://chat.example.com", http.MethodOptions, http.StatusNoContent, true},
+		{"malformed origin", []string{"*"}, "null", http.MethodPost, http.StatusForbidden, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetOriginPolicy(OriginPolicy{Allowed: tt.allowed}); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(tt.method, "https://omiro.test/session/new", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			CORS(next).ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			wantOrigin := ""
+			if w.Code < 400 {
+				wantOrigin = tt.origin
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != wantOrigin {
+				t.Fatalf("Access-Control-Allow-Origin = %q, want %q", got, wantOrigin)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials") == "true"; got != tt.credentials {
+				t.Fatalf("credentials allowed = %v, want %v", got, tt.credentials)
+			}
+		})
+	}
+}
+
+func TestSetOriginPolicyRejectsInvalid(t *testing.T) {
+	t.Cleanup(func() { SetOriginPolicy(OriginPolicy{}) })
+	for _, bad := range []string{"chat.example.com", "https://", "https://a.example.com/path", "https://a.*.example.com"} {
+		if err := SetOriginPolicy(OriginPolicy{Allowed: []string{bad}}); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
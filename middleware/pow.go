@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math/bits"
+	"net/http"
+	"omiro/redis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const powChallengeTTL = 2 * time.Minute
+
+// ProofOfWork is a hashcash-style challenge: the client must find a solution
+// such that sha256(challenge + ":" + solution) starts with Difficulty zero
+// bits. Challenges are signed with the session keyring, so any server can
+// verify them, and each one can be redeemed once.
+type ProofOfWork struct {
+	Difficulty    int
+	MaxDifficulty int
+	// PressureStep raises difficulty by one bit for every PressureStep
+	// handshakes rejected by the rate limiter in the last minute.
+	PressureStep int
+}
+
+func (p *ProofOfWork) Name() string { return "pow" }
+
+func (p *ProofOfWork) Issue(r *http.Request) (map[string]any, error) {
+	kid, secret := currentSigningKey()
+	if secret == nil {
+		return nil, fmt.Errorf("no signing key for challenge")
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	exp := time.Now().Add(powChallengeTTL).Unix()
+	difficulty := p.difficulty(r.Context())
+
+	msg := fmt.Sprintf("pow:%s:%s:%d:%d", kid, nonce, exp, difficulty)
+	challenge := fmt.Sprintf("%s:%s:%d:%d:%s", kid, nonce, exp, difficulty, signToken(secret, msg))
+
+	return map[string]any{
+		"challenge":  challenge,
+		"difficulty": difficulty,
+		"expires_at": exp,
+	}, nil
+}
+
+func (p *ProofOfWork) Verify(r *http.Request) error {
+	challenge := challengeParam(r, "challenge", "X-Challenge")
+	solution := challengeParam(r, "solution", "X-Challenge-Solution")
+	if challenge == "" || solution == "" {
+		return ErrChallengeRequired
+	}
+
+	parts := strings.Split(challenge, ":")
+	if len(parts) != 5 {
+		return ErrChallengeFailed
+	}
+	kid, nonce, expStr, diffStr, sig := parts[0], parts[1], parts[2], parts[3], parts[4]
+
+	secret, ok := lookupSigningKey(kid)
+	if !ok {
+		return ErrChallengeFailed
+	}
+	msg := fmt.Sprintf("pow:%s:%s:%s:%s", kid, nonce, expStr, diffStr)
+	if !hmac.Equal([]byte(signToken(secret, msg)), []byte(sig)) {
+		return ErrChallengeFailed
+	}
+
+	exp, err := strconv.ParseInt(expStr, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return ErrChallengeFailed
+	}
+	difficulty, err := strconv.Atoi(diffStr)
+	if err != nil {
+		return ErrChallengeFailed
+	}
+
+	sum := sha256.Sum256([]byte(challenge + ":" + solution))
+	if leadingZeroBits(sum[:]) < difficulty {
+		return ErrChallengeFailed
+	}
+
+	first, err := redis.MarkChallengeUsed(r.Context(), nonce, time.Until(time.Unix(exp, 0)))
+	if err != nil {
+		slog.Error("failed to mark challenge used", "err", err)
+		return ErrChallengeFailed
+	}
+	if !first {
+		return ErrChallengeFailed
+	}
+	return nil
+}
+
+func (p *ProofOfWork) difficulty(ctx context.Context) int {
+	d := p.Difficulty
+	if p.PressureStep <= 0 || p.MaxDifficulty <= d {
+		return d
+	}
+
+	hits, err := redis.RateLimitHits(ctx, "handshake")
+	if err != nil {
+		return d
+	}
+	d += int(hits) / p.PressureStep
+	if d > p.MaxDifficulty {
+		d = p.MaxDifficulty
+	}
+	return d
+}
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, x := range b {
+		if x != 0 {
+			return n + bits.LeadingZeros8(x)
+		}
+		n += 8
+	}
+	return n
+}
+
+func challengeParam(r *http.Request, query, header string) string {
+	if v := r.URL.Query().Get(query); v != "" {
+		return v
+	}
+	return r.Header.Get(header)
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"omiro/redis"
+	"time"
+)
+
+// Revocations are kept for the longest any token can live, not the current
+// TTL, which may have been longer when the token was issued. The grace
+// period covers clocks that run behind on other servers.
+const (
+	revocationGrace = 5 * time.Minute
+	revocationTTL   = MaxTokenTTL + revocationGrace
+)
+
+// RevokeSession denylists a session until its token would have expired and
+// asks every server to drop live connections opened with it.
+func RevokeSession(ctx context.Context, sessionID string) error {
+	if err := redis.RevokeSession(sessionID, revocationTTL); err != nil {
+		return err
+	}
+	return redis.Broadcast(ctx, map[string]any{
+		"op":         "revoke_sessions",
+		"session_id": sessionID,
+	})
+}
+
+// RevokeIP denylists every session issued to ip so far and drops their live
+// connections cluster-wide.
+func RevokeIP(ctx context.Context, ip string) error {
+	if err := redis.RevokeIP(ip, revocationTTL); err != nil {
+		return err
+	}
+	return redis.Broadcast(ctx, map[string]any{
+		"op":     "revoke_sessions",
+		"ip":     ip,
+		"before": time.Now().Unix(),
+	})
+}
+
+// BanDevice bans a device ID and drops its live connections cluster-wide.
+// Unlike IP bans it follows the user across networks.
+func BanDevice(ctx context.Context, deviceID string, duration time.Duration, reason string) error {
+	if err := redis.BanDevice(deviceID, duration, reason); err != nil {
+		return err
+	}
+	return redis.Broadcast(ctx, map[string]any{
+		"op":        "revoke_sessions",
+		"device_id": deviceID,
+	})
+}
+
+// BanIP bans an address and drops the live connections whose sessions were
+// issued to it.
+func BanIP(ctx context.Context, ip string, duration time.Duration, reason string) error {
+	if err := redis.BanIP(ip, duration, reason); err != nil {
+		return err
+	}
+	return redis.Broadcast(ctx, map[string]any{
+		"op":     "revoke_sessions",
+		"ip":     ip,
+		"before": time.Now().Unix(),
+	})
+}
+
+// BanUser bans an account and drops its live connections cluster-wide.
+func BanUser(ctx context.Context, userID string, duration time.Duration, reason string) error {
+	if err := redis.BanUser(userID, duration, reason); err != nil {
+		return err
+	}
+	return redis.Broadcast(ctx, map[string]any{
+		"op":      "revoke_sessions",
+		"user_id": userID,
+	})
+}
+
+// Ban bans by kind: "ip", "user" or "device". A zero duration never
+// expires.
+func Ban(ctx context.Context, kind, value string, duration time.Duration, reason string) error {
+	switch kind {
+	case "ip":
+		return BanIP(ctx, value, duration, reason)
+	case "user":
+		return BanUser(ctx, value, duration, reason)
+	case "device":
+		return BanDevice(ctx, value, duration, reason)
+	}
+	return fmt.Errorf("unknown ban kind %q", kind)
+}
@@ -3,69 +3,242 @@ package middleware
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
-	"fmt"
-	"strconv"
+	"log/slog"
+	"net"
+	"net/http"
+	"omiro/helper"
+	"omiro/redis"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-var tokenSecret = []byte("replace-with-env-secret")
+var (
+	ErrMalformed    = errors.New("malformed session token")
+	ErrBadSignature = errors.New("bad session token signature")
+	ErrExpired      = errors.New("session token expired")
+	ErrRevoked      = errors.New("session token revoked")
+	ErrWrongClient  = errors.New("session token bound to another client")
+)
 
-func GenerateSessionToken() (string, int64, error) {
-	sid := uuid.NewString()
-	exp := time.Now().Add(10 * time.Minute).Unix()
-	msg := fmt.Sprintf("%s:%d", sid, exp)
-	mac := hmac.New(sha256.New, tokenSecret)
-	mac.Write([]byte(msg))
-	sig := hex.EncodeToString(mac.Sum(nil))
-	token := fmt.Sprintf("%s:%s", msg, sig)
-	return token, exp, nil
+// Session is what a session token carries. Tokens are encoded as
+// base64url(json(Session)) + "." + hex(hmac-sha256), signed with the key
+// named by KeyID.
+type Session struct {
+	ID        string            `json:"sid"`
+	IssuedAt  int64             `json:"iat"`
+	ExpiresAt int64             `json:"exp"`
+	KeyID     string            `json:"kid"`
+	Claims    map[string]string `json:"claims,omitempty"`
 }
 
-func ValidateSessionToken(token string) (string, int64, error) {
-	parts := strings.Split(token, ":")
-	if len(parts) != 2 {
-		return "", 0, errors.New("invalid token")
+// UserID is the stable account ID of a logged-in session, or "" for
+// anonymous sessions.
+func (s *Session) UserID() string {
+	if s == nil {
+		return ""
 	}
-	msg := parts[0]
-	sig := parts[1]
-	mac := hmac.New(sha256.New, tokenSecret)
-	mac.Write([]byte(msg))
-	calculatedSig := hex.EncodeToString(mac.Sum(nil))
-	if sig != calculatedSig {
-		return "", 0, errors.New("invalid token")
+	return s.Claims["uid"]
+}
+
+// DeviceID is the device cookie ID the session was issued to.
+func (s *Session) DeviceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.Claims["did"]
+}
+
+type TokenOptions struct {
+	TTL time.Duration
+	// SingleUse lets a token open only one WebSocket connection.
+	SingleUse bool
+	// BindIP ties the token to the issuing client's IP, masked to the given
+	// prefix lengths so clients hopping inside one network keep working.
+	BindIP     bool
+	IPv4Prefix int
+	IPv6Prefix int
+	// BindUserAgent ties the token to a hash of the issuing User-Agent.
+	BindUserAgent bool
+}
+
+// MaxTokenTTL caps TokenOptions.TTL. Revocations are kept this long, so
+// they outlive every token that can still verify whatever TTL issued it.
+const MaxTokenTTL = 24 * time.Hour
+
+var tokenOptions = TokenOptions{
+	TTL:        10 * time.Minute,
+	IPv4Prefix: 32,
+	IPv6Prefix: 64,
+}
+
+func SetTokenOptions(opts TokenOptions) {
+	if opts.TTL <= 0 {
+		opts.TTL = 10 * time.Minute
+	}
+	if opts.TTL > MaxTokenTTL {
+		opts.TTL = MaxTokenTTL
+	}
+	if opts.IPv4Prefix <= 0 || opts.IPv4Prefix > 32 {
+		opts.IPv4Prefix = 32
+	}
+	if opts.IPv6Prefix <= 0 || opts.IPv6Prefix > 128 {
+		opts.IPv6Prefix = 64
 	}
-	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	tokenOptions = opts
+}
+
+// IssueSession creates a session for the client making r, signs it with the
+// current key and returns it with its token. claims are copied into the token.
+func IssueSession(r *http.Request, claims map[string]string) (*Session, string, error) {
+	kid, secret := currentSigningKey()
+	if secret == nil {
+		return nil, "", errors.New("no session signing key configured")
+	}
+
+	now := time.Now()
+	s := &Session{
+		ID:        uuid.NewString(),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(tokenOptions.TTL).Unix(),
+		KeyID:     kid,
+		Claims:    map[string]string{},
+	}
+	for k, v := range claims {
+		s.Claims[k] = v
+	}
+	// the issuing IP lets RevokeIP find this session later
+	s.Claims["ip"] = helper.GetRealIP(r)
+	if bind := requestBinding(r); bind != "" {
+		s.Claims["bind"] = bind
+	}
+
+	payload, err := json.Marshal(s)
 	if err != nil {
-		return "", 0, errors.New("invalid token")
+		return nil, "", err
 	}
-	expTime := time.Unix(exp, 0)
-	if time.Now().After(expTime) {
-		return "", 0, errors.New("token expired")
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	return s, body + "." + signToken(secret, body), nil
+}
+
+// ParseSession verifies token, checks it was presented by the client it is
+// bound to and hasn't been revoked, and returns the session. Errors are one
+// of ErrMalformed, ErrBadSignature, ErrExpired, ErrRevoked or ErrWrongClient,
+// or a Redis error if the revocation list can't be read.
+func ParseSession(token string, r *http.Request) (*Session, error) {
+	body, sig, ok := strings.Cut(token, ".")
+	if !ok || body == "" || sig == "" {
+		return nil, ErrMalformed
 	}
-	return msg, expTime.Unix(), nil
+
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var s Session
+	if err := json.Unmarshal(payload, &s); err != nil || s.ID == "" || s.ExpiresAt == 0 {
+		return nil, ErrMalformed
+	}
+
+	secret, ok := lookupSigningKey(s.KeyID)
+	if !ok {
+		return nil, ErrBadSignature
+	}
+	if !hmac.Equal([]byte(signToken(secret, body)), []byte(sig)) {
+		return nil, ErrBadSignature
+	}
+
+	if time.Now().Unix() > s.ExpiresAt {
+		return nil, ErrExpired
+	}
+	// a revocation would expire before a longer-lived token does
+	if s.ExpiresAt-s.IssuedAt > int64(MaxTokenTTL.Seconds()) {
+		return nil, ErrExpired
+	}
+
+	revoked, err := redis.IsSessionRevoked(r.Context(), s.ID, s.Claims["ip"], s.IssuedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrRevoked
+	}
+
+	if !hmac.Equal([]byte(s.Claims["bind"]), []byte(requestBinding(r))) {
+		return nil, ErrWrongClient
+	}
+
+	return &s, nil
 }
 
-func VerifySessionToken(token string) bool {
-	parts := strings.Split(token, ":")
-	if len(parts) != 3 {
-		return false
+// ConsumeSession parses token and, in single-use mode, marks the session as
+// used so the same token can't open a second connection. A reused token is
+// reported as ErrRevoked.
+func ConsumeSession(token string, r *http.Request) (*Session, error) {
+	s, err := ParseSession(token, r)
+	if err != nil {
+		return nil, err
+	}
+	if !tokenOptions.SingleUse {
+		return s, nil
 	}
-	sid, expStr, sig := parts[0], parts[1], parts[2]
-	exp, err := strconv.ParseInt(expStr, 10, 64)
+
+	first, err := redis.MarkSessionUsed(r.Context(), s.ID, time.Until(time.Unix(s.ExpiresAt, 0)))
 	if err != nil {
-		return false
+		slog.Error("failed to mark session used", "err", err)
+		return nil, err
 	}
-	if time.Now().Unix() > exp {
-		return false
+	if !first {
+		return nil, ErrRevoked
 	}
-	msg := fmt.Sprintf("%s:%s", sid, expStr)
-	mac := hmac.New(sha256.New, tokenSecret)
+	return s, nil
+}
+
+// TokenFromRequest reads the session token from the query string or the
+// X-Session-Token header.
+func TokenFromRequest(r *http.Request) string {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = r.Header.Get("X-Session-Token")
+	}
+	return token
+}
+
+func signToken(secret []byte, msg string) string {
+	mac := hmac.New(sha256.New, secret)
 	mac.Write([]byte(msg))
-	expected := hex.EncodeToString(mac.Sum(nil))
-	return hmac.Equal([]byte(expected), []byte(sig))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// requestBinding hashes the parts of r that tokens are bound to, or returns
+// "" when binding is off.
+func requestBinding(r *http.Request) string {
+	if !tokenOptions.BindIP && !tokenOptions.BindUserAgent {
+		return ""
+	}
+
+	h := sha256.New()
+	if tokenOptions.BindIP {
+		h.Write([]byte("ip=" + maskIP(helper.GetRealIP(r)) + ";"))
+	}
+	if tokenOptions.BindUserAgent {
+		h.Write([]byte("ua=" + r.UserAgent() + ";"))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+func maskIP(raw string) string {
+	ip := net.ParseIP(raw)
+	if ip == nil {
+		return raw
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(tokenOptions.IPv4Prefix, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(tokenOptions.IPv6Prefix, 128)).String()
 }
@@ -0,0 +1,223 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"omiro/redis"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupSessions is setupChallenges with the given token options, restored to
+// the defaults when the test ends.
+func setupSessions(t *testing.T, opts TokenOptions) {
+	t.Helper()
+	setupChallenges(t)
+	SetTokenOptions(opts)
+	t.Cleanup(func() { SetTokenOptions(TokenOptions{}) })
+}
+
+// sessionRequest is a request from ip with the given User-Agent.
+func sessionRequest(ip, ua string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.RemoteAddr = net.JoinHostPort(ip, "40000")
+	r.Header.Set("User-Agent", ua)
+	return r
+}
+
+// signSession encodes s and signs it with secret, bypassing IssueSession.
+func signSession(t *testing.T, s Session, secret string) string {
+	t.Helper()
+	payload, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	return body + "." + signToken([]byte(secret), body)
+}
+
+func TestParseSession(t *testing.T) {
+	setupSessions(t, TokenOptions{})
+	r := sessionRequest("192.0.2.1", "test")
+
+	_, valid, err := IssueSession(r, map[string]string{"uid": "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, sig, _ := strings.Cut(valid, ".")
+	now := time.Now()
+
+	// tampered re-encodes the valid token's payload with uid changed but
+	// keeps the original signature
+	payload, _ := base64.RawURLEncoding.DecodeString(body)
+	var s Session
+	json.Unmarshal(payload, &s)
+	s.Claims["uid"] = "admin"
+	forged, _ := json.Marshal(s)
+	tampered := base64.RawURLEncoding.EncodeToString(forged) + "." + sig
+
+	flipped := []byte(sig)
+	flipped[0] ^= 1
+
+	revoked, revokedToken, err := IssueSession(r, map[string]string{"uid": "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := redis.RevokeSession(revoked.ID, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"valid", valid, nil},
+		{"empty", "", ErrMalformed},
+		{"no signature", body, ErrMalformed},
+		{"empty signature", body + ".", ErrMalformed},
+		{"not base64", "!!!." + sig, ErrMalformed},
+		{"not json", base64.RawURLEncoding.EncodeToString([]byte("nope")) + "." + sig, ErrMalformed},
+		{"tampered body", tampered, ErrBadSignature},
+		{"tampered signature", body + "." + string(flipped), ErrBadSignature},
+		{"unknown key", signSession(t, Session{ID: "s", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix(), KeyID: "other"}, "test-secret"), ErrBadSignature},
+		{"signed with another secret", signSession(t, Session{ID: "s", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix(), KeyID: "test"}, "guessed"), ErrBadSignature},
+		{"expired", signSession(t, Session{ID: "s", IssuedAt: now.Add(-time.Hour).Unix(), ExpiresAt: now.Add(-time.Minute).Unix(), KeyID: "test"}, "test-secret"), ErrExpired},
+		{"revoked", revokedToken, ErrRevoked},
+		{"lifetime over the cap", signSession(t, Session{ID: "s", IssuedAt: now.Unix(), ExpiresAt: now.Add(MaxTokenTTL + time.Hour).Unix(), KeyID: "test"}, "test-secret"), ErrExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSession(tt.token, r)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("ParseSession() error = %v, want %v", err, tt.want)
+			}
+			if err == nil && got.UserID() != "u1" {
+				t.Fatalf("uid = %q", got.UserID())
+			}
+		})
+	}
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	setupSessions(t, TokenOptions{})
+	r := sessionRequest("192.0.2.1", "test")
+
+	_, old, err := IssueSession(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate: new tokens use "next", "test" still verifies
+	if err := SetSigningKeys([]SigningKey{{ID: "next", Secret: "next-secret"}, {ID: "test", Secret: "test-secret"}}, "next"); err != nil {
+		t.Fatal(err)
+	}
+	s, fresh, err := IssueSession(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.KeyID != "next" {
+		t.Fatalf("new token signed with %q, want next", s.KeyID)
+	}
+
+	steps := []struct {
+		name     string
+		keys     []SigningKey
+		old, new error
+	}{
+		{"after rotation", []SigningKey{{ID: "next", Secret: "next-secret"}, {ID: "test", Secret: "test-secret"}}, nil, nil},
+		{"old key retired", []SigningKey{{ID: "next", Secret: "next-secret"}, {ID: "test", Secret: "test-secret", Retired: true}}, ErrBadSignature, nil},
+		{"old key removed", []SigningKey{{ID: "next", Secret: "next-secret"}}, ErrBadSignature, nil},
+		{"secret replaced under the same id", []SigningKey{{ID: "next", Secret: "other-secret"}}, ErrBadSignature, ErrBadSignature},
+	}
+	for _, st := range steps {
+		t.Run(st.name, func(t *testing.T) {
+			if err := SetSigningKeys(st.keys, "next"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ParseSession(old, r); !errors.Is(err, st.old) {
+				t.Fatalf("old token: %v, want %v", err, st.old)
+			}
+			if _, err := ParseSession(fresh, r); !errors.Is(err, st.new) {
+				t.Fatalf("new token: %v, want %v", err, st.new)
+			}
+		})
+	}
+}
+
+func TestConsumeSessionReplay(t *testing.T) {
+	for _, singleUse := range []bool{false, true} {
+		setupSessions(t, TokenOptions{SingleUse: singleUse})
+		r := sessionRequest("192.0.2.1", "test")
+		_, token, err := IssueSession(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ConsumeSession(token, r); err != nil {
+			t.Fatalf("single use %v: first use: %v", singleUse, err)
+		}
+		_, err = ConsumeSession(token, r)
+		if singleUse && !errors.Is(err, ErrRevoked) {
+			t.Fatalf("replay: %v, want %v", err, ErrRevoked)
+		}
+		if !singleUse && err != nil {
+			t.Fatalf("reuse without single use: %v", err)
+		}
+		// parsing alone never uses the token up
+		if _, err := ParseSession(token, r); err != nil {
+			t.Fatalf("single use %v: parse after use: %v", singleUse, err)
+		}
+	}
+}
+
+func TestSessionBinding(t *testing.T) {
+	issuer := sessionRequest("203.0.113.7", "browser/1")
+
+	tests := []struct {
+		name string
+		opts TokenOptions
+		from *http.Request
+		want error
+	}{
+		{"unbound, other client", TokenOptions{}, sessionRequest("198.51.100.1", "curl"), nil},
+		{"ip, same client", TokenOptions{BindIP: true}, sessionRequest("203.0.113.7", "browser/1"), nil},
+		{"ip, other ip", TokenOptions{BindIP: true}, sessionRequest("203.0.113.8", "browser/1"), ErrWrongClient},
+		{"ip, other ip in prefix", TokenOptions{BindIP: true, IPv4Prefix: 24}, sessionRequest("203.0.113.8", "browser/1"), nil},
+		{"ip, outside prefix", TokenOptions{BindIP: true, IPv4Prefix: 24}, sessionRequest("203.0.114.7", "browser/1"), ErrWrongClient},
+		{"ip, other user agent", TokenOptions{BindIP: true}, sessionRequest("203.0.113.7", "curl"), nil},
+		{"user agent, same", TokenOptions{BindUserAgent: true}, sessionRequest("198.51.100.1", "browser/1"), nil},
+		{"user agent, other", TokenOptions{BindUserAgent: true}, sessionRequest("203.0.113.7", "curl"), ErrWrongClient},
+		{"both, one differs", TokenOptions{BindIP: true, BindUserAgent: true}, sessionRequest("203.0.113.7", "curl"), ErrWrongClient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupSessions(t, tt.opts)
+			_, token, err := IssueSession(issuer, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ParseSession(token, tt.from); !errors.Is(err, tt.want) {
+				t.Fatalf("ParseSession() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// IPv6 clients are bound to their /64 by default
+	setupSessions(t, TokenOptions{BindIP: true})
+	_, token, err := IssueSession(sessionRequest("2001:db8:1:2::10", "browser/1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseSession(token, sessionRequest("2001:db8:1:2::99", "browser/1")); err != nil {
+		t.Fatalf("same /64: %v", err)
+	}
+	if _, err := ParseSession(token, sessionRequest("2001:db8:1:3::10", "browser/1")); !errors.Is(err, ErrWrongClient) {
+		t.Fatalf("other /64: %v, want %v", err, ErrWrongClient)
+	}
+}
@@ -0,0 +1,163 @@
+package oidc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MockProvider is a tiny in-process identity provider for local development
+// and tests. It approves every login immediately, using the login_hint query
+// parameter (default "mock-user") as the subject, and enforces PKCE.
+type MockProvider struct {
+	Issuer string
+
+	mu    sync.Mutex
+	codes map[string]mockCode
+	key   []byte
+}
+
+type mockCode struct {
+	clientID    string
+	redirectURI string
+	nonce       string
+	challenge   string
+	subject     string
+	expires     time.Time
+}
+
+func NewMockProvider(issuer string) *MockProvider {
+	return &MockProvider{
+		Issuer: strings.TrimRight(issuer, "/"),
+		codes:  make(map[string]mockCode),
+		key:    []byte(randomString(32)),
+	}
+}
+
+func (m *MockProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/.well-known/openid-configuration"):
+		m.discovery(w)
+	case strings.HasSuffix(r.URL.Path, "/authorize"):
+		m.authorize(w, r)
+	case strings.HasSuffix(r.URL.Path, "/token"):
+		m.token(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *MockProvider) discovery(w http.ResponseWriter) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                m.Issuer,
+		"authorization_endpoint":                m.Issuer + "/authorize",
+		"token_endpoint":                        m.Issuer + "/token",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"HS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (m *MockProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "unsupported request", http.StatusBadRequest)
+		return
+	}
+
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirect.Scheme == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	subject := q.Get("login_hint")
+	if subject == "" {
+		subject = "mock-user"
+	}
+
+	code := randomString(16)
+	m.mu.Lock()
+	m.codes[code] = mockCode{
+		clientID:    q.Get("client_id"),
+		redirectURI: q.Get("redirect_uri"),
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+		subject:     subject,
+		expires:     time.Now().Add(time.Minute),
+	}
+	m.mu.Unlock()
+
+	rq := redirect.Query()
+	rq.Set("code", code)
+	rq.Set("state", q.Get("state"))
+	redirect.RawQuery = rq.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (m *MockProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	m.mu.Lock()
+	c, ok := m.codes[code]
+	delete(m.codes, code)
+	m.mu.Unlock()
+
+	if !ok || time.Now().After(c.expires) ||
+		c.clientID != r.PostForm.Get("client_id") ||
+		c.redirectURI != r.PostForm.Get("redirect_uri") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != c.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	idToken := m.sign(map[string]any{
+		"iss":   m.Issuer,
+		"sub":   c.subject,
+		"aud":   c.clientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": c.nonce,
+		"email": c.subject + "@mock.invalid",
+	})
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": randomString(16),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (m *MockProvider) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	msg := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(msg))
+	return msg + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,246 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidIDToken = errors.New("invalid id token")
+
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // optional, public clients rely on PKCE alone
+	RedirectURL  string
+	Scopes       []string
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+// Provider runs the authorization-code flow with PKCE against an OpenID
+// Connect issuer. The discovery document is fetched on first use.
+type Provider struct {
+	cfg    Config
+	client *http.Client
+
+	mu  sync.Mutex
+	doc *discovery
+}
+
+// Claims are the ID token claims we rely on.
+type Claims struct {
+	Issuer   string   `json:"iss"`
+	Subject  string   `json:"sub"`
+	Audience audience `json:"aud"`
+	Expiry   int64    `json:"exp"`
+	Nonce    string   `json:"nonce"`
+	Email    string   `json:"email,omitempty"`
+}
+
+// AuthRequest is the per-login state kept between the redirect to the
+// provider and the callback.
+type AuthRequest struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+func New(cfg Config) *Provider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid"}
+	}
+	cfg.Issuer = strings.TrimRight(cfg.Issuer, "/")
+	return &Provider{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func NewAuthRequest() AuthRequest {
+	return AuthRequest{
+		State:    randomString(24),
+		Nonce:    randomString(24),
+		Verifier: randomString(48),
+	}
+}
+
+// AuthURL is where the browser is sent to log in.
+func (p *Provider) AuthURL(ctx context.Context, req AuthRequest) (string, error) {
+	doc, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(req.Verifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", req.State)
+	q.Set("nonce", req.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(doc.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return doc.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange trades the authorization code for tokens and returns the checked
+// ID token claims. The ID token comes straight from the token endpoint over
+// TLS, which OIDC Core 3.1.3.7 accepts in place of a signature check.
+func (p *Provider) Exchange(ctx context.Context, code string, req AuthRequest) (*Claims, error) {
+	doc, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("client_id", p.cfg.ClientID)
+	form.Set("code_verifier", req.Verifier)
+	if p.cfg.ClientSecret != "" {
+		form.Set("client_secret", p.cfg.ClientSecret)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("token endpoint: %s: %s", resp.Status, body)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+
+	claims, err := decodeIDToken(tokens.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Issuer != doc.Issuer || !claims.Audience.contains(p.cfg.ClientID) {
+		return nil, ErrInvalidIDToken
+	}
+	if claims.Nonce != req.Nonce || claims.Subject == "" {
+		return nil, ErrInvalidIDToken
+	}
+	if time.Now().Unix() > claims.Expiry {
+		return nil, ErrInvalidIDToken
+	}
+	return claims, nil
+}
+
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.doc != nil {
+		return p.doc, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery: %s", resp.Status)
+	}
+
+	var doc discovery
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(doc.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer mismatch %q", doc.Issuer)
+	}
+	doc.Issuer = strings.TrimRight(doc.Issuer, "/")
+
+	p.doc = &doc
+	return p.doc, nil
+}
+
+func decodeIDToken(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	claims.Issuer = strings.TrimRight(claims.Issuer, "/")
+	return &claims, nil
+}
+
+// audience accepts both the string and array forms of "aud".
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a audience) contains(id string) bool {
+	for _, v := range a {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"omiro/metrics"
+	"omiro/redis"
+	"time"
+)
+
+// runReaper cleans up after dead servers every interval until ctx is done.
+// It must only run on the leader.
+func runReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		reapDeadServers(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func reapDeadServers(ctx context.Context) {
+	dead, err := redis.DeadServers(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("failed to look for dead servers", "err", err)
+		}
+		return
+	}
+
+	for _, id := range dead {
+		n, err := redis.ReapServer(ctx, leader, id)
+		if errors.Is(err, redis.ErrServerAlive) {
+			continue
+		}
+		if errors.Is(err, redis.ErrNotLeader) {
+			slog.Warn("reaper stopped, lease lost")
+			return
+		}
+		if err != nil {
+			slog.Error("failed to reap dead server", "dead_server_id", id, "err", err)
+			continue
+		}
+		metrics.ReapedServers.Inc()
+		metrics.ReapedClients.Add(float64(n))
+		slog.Info("reaped dead server", "dead_server_id", id, "clients", n)
+	}
+}
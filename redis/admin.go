@@ -0,0 +1,215 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrNotPaired = errors.New("client is not paired")
+
+// Operator actions shared by the /admin API and omiroctl. Actions on a
+// client are published to the server holding it, which carries them out.
+
+// KickClient asks the client's server to close its connection.
+func KickClient(ctx context.Context, clientID, reason string) (*ClientMeta, error) {
+	meta, err := GetClient(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+	return meta, SendToServer(ctx, meta.ServerID, map[string]any{
+		"op":        "kick_client",
+		"client_id": meta.ID,
+		"reason":    reason,
+	})
+}
+
+// UnpairClient asks the client's server to end its current pairing.
+func UnpairClient(ctx context.Context, clientID string) (*ClientMeta, error) {
+	meta, err := GetClient(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if meta.PartnerID == "" {
+		return meta, ErrNotPaired
+	}
+	return meta, SendToServer(ctx, meta.ServerID, map[string]any{
+		"op":        "unpair_client",
+		"client_id": meta.ID,
+	})
+}
+
+// Announcement is a system message shown to every connected client.
+type Announcement struct {
+	Message  string `json:"message"`
+	Severity string `json:"severity"` // info, warning or critical
+	// ExpiresAt is when clients should stop showing it. Until then it is
+	// also sent to clients that connect later. Zero shows it once.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+func (a Announcement) Validate() error {
+	if a.Message == "" {
+		return errors.New("announcement message is required")
+	}
+	switch a.Severity {
+	case "info", "warning", "critical":
+	default:
+		return fmt.Errorf("unknown announcement severity %q", a.Severity)
+	}
+	if a.ExpiresAt != 0 && a.ExpiresAt <= time.Now().Unix() {
+		return errors.New("announcement expiry is in the past")
+	}
+	return nil
+}
+
+// Announce delivers a to every client on every live server, and keeps it
+// for late joiners until it expires. It replaces the stored announcement
+// either way, so a one-off message also ends the previous one.
+func Announce(ctx context.Context, a Announcement) error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	if a.ExpiresAt != 0 {
+		b, _ := json.Marshal(a)
+		ttl := time.Until(time.Unix(a.ExpiresAt, 0))
+		if err := Client.Set(ctx, "announcement", b, ttl).Err(); err != nil {
+			return err
+		}
+	} else if err := Client.Del(ctx, "announcement").Err(); err != nil {
+		return err
+	}
+	return Broadcast(ctx, map[string]any{
+		"op":           "announce",
+		"announcement": a,
+	})
+}
+
+// ActiveAnnouncement returns the announcement new clients should see, or
+// nil if there is none.
+func ActiveAnnouncement(ctx context.Context) (*Announcement, error) {
+	raw, err := Client.Get(ctx, "announcement").Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var a Announcement
+	if err := json.Unmarshal(raw, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// Maintenance is set while operators hold off new sessions and matches.
+// Calls already in progress carry on.
+type Maintenance struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+	Since   int64  `json:"since,omitempty"`
+}
+
+// GetMaintenance returns the current maintenance state.
+func GetMaintenance(ctx context.Context) (*Maintenance, error) {
+	raw, err := Client.Get(ctx, "maintenance").Bytes()
+	if err == redis.Nil {
+		return &Maintenance{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m Maintenance
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// SetMaintenance turns maintenance mode on with message, or off. The flag
+// has no expiry; it stays until turned off.
+func SetMaintenance(ctx context.Context, enabled bool, message string) error {
+	if !enabled {
+		return Client.Del(ctx, "maintenance").Err()
+	}
+	b, _ := json.Marshal(Maintenance{
+		Enabled: true,
+		Message: message,
+		Since:   time.Now().Unix(),
+	})
+	return Client.Set(ctx, "maintenance", b, 0).Err()
+}
+
+// AllClients returns the clients registered on every live server.
+func AllClients(ctx context.Context) ([]ClientMeta, error) {
+	servers, err := ListServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []ClientMeta
+	for _, id := range servers {
+		metas, err := ServerClients(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, metas...)
+	}
+	return out, nil
+}
+
+type Stats struct {
+	Servers     int  `json:"servers"`
+	Clients     int  `json:"clients"`
+	Queued      int  `json:"queued"`
+	Pairs       int  `json:"pairs"`
+	OpenReports int  `json:"open_reports"`
+	Bans        int  `json:"bans"`
+	Maintenance bool `json:"maintenance"`
+}
+
+// ClusterStats totals up the cluster from the registry, reports and bans.
+func ClusterStats(ctx context.Context) (*Stats, error) {
+	servers, err := ListServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	clients, err := AllClients(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reports, err := ListReports(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	bans, err := ListBans(ctx)
+	if err != nil {
+		return nil, err
+	}
+	maintenance, err := GetMaintenance(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Stats{
+		Servers:     len(servers),
+		Clients:     len(clients),
+		OpenReports: len(reports),
+		Bans:        len(bans),
+		Maintenance: maintenance.Enabled,
+	}
+	paired := 0
+	for _, c := range clients {
+		if c.InQueue {
+			s.Queued++
+		}
+		if c.PartnerID != "" {
+			paired++
+		}
+	}
+	s.Pairs = paired / 2
+	return s, nil
+}
@@ -0,0 +1,39 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestAnnounceReplacesStoredAnnouncement(t *testing.T) {
+	m := miniredis.RunT(t)
+	if err := Init(Config{Host: m.Host(), Port: m.Port()}); err != nil {
+		t.Fatal(err)
+	}
+
+	lasting := Announcement{Message: "maintenance at 10:00", Severity: "warning", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	if err := Announce(Ctx, lasting); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := ActiveAnnouncement(Ctx); err != nil || a == nil || a.Message != lasting.Message {
+		t.Fatalf("ActiveAnnouncement() = %+v, %v", a, err)
+	}
+
+	// a one-off message supersedes it for clients that connect later too
+	if err := Announce(Ctx, Announcement{Message: "maintenance cancelled", Severity: "info"}); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := ActiveAnnouncement(Ctx); err != nil || a != nil {
+		t.Fatalf("ActiveAnnouncement() = %+v, %v, want none", a, err)
+	}
+
+	if err := Announce(Ctx, lasting); err != nil {
+		t.Fatal(err)
+	}
+	m.FastForward(time.Hour + time.Second)
+	if a, err := ActiveAnnouncement(Ctx); err != nil || a != nil {
+		t.Fatalf("expired announcement still active: %+v, %v", a, err)
+	}
+}
@@ -1,26 +1,165 @@
 package redis
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
+
+	"github.com/redis/go-redis/v9"
 )
 
-func StoreChatMessage(roomID, senderID, message string) error {
-	key := fmt.Sprintf("chat:%s", roomID)
-	msgData := map[string]any{
-		"sender_id": senderID,
-		"message":   message,
-		"timestamp": time.Now().Unix(),
+// transcripts and their moderation evidence live this long after the last message
+const chatTTL = 24 * time.Hour
+
+// a busy room can make an update lose its WATCH race; give up after this many tries
+const maxChatUpdateAttempts = 5
+
+var ErrMessageNotFound = errors.New("message not found")
+
+type ChatMessage struct {
+	ID        string            `json:"id"`
+	SenderID  string            `json:"sender_id"`
+	Message   string            `json:"message"`
+	Media     string            `json:"media,omitempty"`
+	Timestamp int64             `json:"timestamp"`
+	EditedAt  int64             `json:"edited_at,omitempty"`
+	Deleted   bool              `json:"deleted,omitempty"`
+	Reactions map[string]string `json:"reactions,omitempty"`
+}
+
+// StoreChatMessage appends msg, as delivered, to the room transcript. A copy
+// with the text as the sender wrote it, before filters redacted anything, is
+// kept in chat:<room>:evidence, which edits and deletions never touch, so
+// moderators always see what was actually sent.
+func StoreChatMessage(ctx context.Context, roomID string, msg ChatMessage, sent string) error {
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().Unix()
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
 	}
-	jsonData, err := json.Marshal(msgData)
+	original := msg
+	original.Message = sent
+	evidence, err := json.Marshal(original)
 	if err != nil {
 		return err
 	}
-	return Client.LPush(Ctx, key, jsonData).Err()
+
+	key := fmt.Sprintf("chat:%s", roomID)
+	pipe := Client.TxPipeline()
+	pipe.HSet(ctx, key, msg.ID, b)
+	pipe.RPush(ctx, key+":order", msg.ID)
+	pipe.HSetNX(ctx, key+":evidence", msg.ID, evidence)
+	pipe.Expire(ctx, key, chatTTL)
+	pipe.Expire(ctx, key+":order", chatTTL)
+	pipe.Expire(ctx, key+":evidence", chatTTL)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func GetChatMessage(ctx context.Context, roomID, msgID string) (*ChatMessage, error) {
+	raw, err := Client.HGet(ctx, fmt.Sprintf("chat:%s", roomID), msgID).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var msg ChatMessage
+	if err := json.Unmarshal([]byte(raw), &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
 }
 
-func GetChatHistory(roomID string, count int64) ([]string, error) {
+// UpdateChatMessage applies fn to the transcript copy of a message and saves
+// it. The read and the write run in a WATCH transaction that is retried if
+// the room changes in between, so concurrent edits, reactions and deletions
+// don't overwrite each other. An error from fn aborts the update and is
+// returned as is.
+func UpdateChatMessage(ctx context.Context, roomID, msgID string, fn func(*ChatMessage) error) (*ChatMessage, error) {
 	key := fmt.Sprintf("chat:%s", roomID)
-	return Client.LRange(Ctx, key, 0, count-1).Result()
+
+	var msg *ChatMessage
+	update := func(tx *redis.Tx) error {
+		raw, err := tx.HGet(ctx, key, msgID).Result()
+		if errors.Is(err, redis.Nil) {
+			return ErrMessageNotFound
+		}
+		if err != nil {
+			return err
+		}
+		msg = &ChatMessage{}
+		if err := json.Unmarshal([]byte(raw), msg); err != nil {
+			return err
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+		b, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, msgID, b)
+			return nil
+		})
+		return err
+	}
+
+	for range maxChatUpdateAttempts {
+		err := Client.Watch(ctx, update, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+	return nil, redis.TxFailedErr
+}
+
+// GetChatHistory returns the last count messages of a room, oldest first,
+// as they currently read after edits and deletions.
+func GetChatHistory(roomID string, count int64) ([]ChatMessage, error) {
+	key := fmt.Sprintf("chat:%s", roomID)
+
+	ids, err := Client.LRange(Ctx, key+":order", -count, -1).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	raws, err := Client.HMGet(Ctx, key, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]ChatMessage, 0, len(raws))
+	for _, raw := range raws {
+		s, ok := raw.(string)
+		if !ok {
+			continue
+		}
+		var msg ChatMessage
+		if err := json.Unmarshal([]byte(s), &msg); err == nil {
+			history = append(history, msg)
+		}
+	}
+	return history, nil
+}
+
+// GetChatEvidence returns the original, unedited version of a message.
+func GetChatEvidence(roomID, msgID string) (*ChatMessage, error) {
+	raw, err := Client.HGet(Ctx, fmt.Sprintf("chat:%s:evidence", roomID), msgID).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var msg ChatMessage
+	if err := json.Unmarshal([]byte(raw), &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
 }
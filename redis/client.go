@@ -3,7 +3,7 @@ package redis
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -19,9 +19,26 @@ type Config struct {
 	Port     string
 	Password string
 	DB       int
+
+	// ClientTTL and ServerTTL bound how long client metadata and server
+	// heartbeats live. Zero keeps the defaults.
+	ClientTTL time.Duration
+	ServerTTL time.Duration
 }
 
+var (
+	clientTTL = 2 * time.Hour
+	serverTTL = 60 * time.Second
+)
+
 func Init(cfg Config) error {
+	if cfg.ClientTTL > 0 {
+		clientTTL = cfg.ClientTTL
+	}
+	if cfg.ServerTTL > 0 {
+		serverTTL = cfg.ServerTTL
+	}
+
 	Client = redis.NewClient(&redis.Options{
 		Addr:         fmt.Sprintf("%s:%s", cfg.Host, cfg.Port),
 		Password:     cfg.Password,
@@ -32,13 +49,14 @@ func Init(cfg Config) error {
 		PoolSize:     10,
 		PoolTimeout:  4 * time.Second,
 	})
+	Client.AddHook(tracingHook{})
 
 	_, err := Client.Ping(Ctx).Result()
 	if err != nil {
 		return fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
-	log.Println("Redis connected successfully")
+	slog.Info("redis connected")
 	return nil
 }
 
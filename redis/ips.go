@@ -1,7 +1,9 @@
 package redis
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -10,9 +12,9 @@ func BanIP(ip string, duration time.Duration, reason string) error {
 	return Client.Set(Ctx, key, reason, duration).Err()
 }
 
-func IsIPBanned(ip string) (bool, string, error) {
+func IsIPBanned(ctx context.Context, ip string) (bool, string, error) {
 	key := fmt.Sprintf("ban:%s", ip)
-	reason, err := Client.Get(Ctx, key).Result()
+	reason, err := Client.Get(ctx, key).Result()
 	if err != nil {
 		if err.Error() == "redis: nil" {
 			return false, "", nil
@@ -26,3 +28,97 @@ func UnbanIP(ip string) error {
 	key := fmt.Sprintf("ban:%s", ip)
 	return Client.Del(Ctx, key).Err()
 }
+
+// User bans key on the account user ID and apply to logged-in sessions
+// regardless of the IP they connect from.
+func BanUser(userID string, duration time.Duration, reason string) error {
+	return Client.Set(Ctx, "ban:user:"+userID, reason, duration).Err()
+}
+
+func IsUserBanned(ctx context.Context, userID string) (bool, string, error) {
+	reason, err := Client.Get(ctx, "ban:user:"+userID).Result()
+	if err != nil {
+		if err.Error() == "redis: nil" {
+			return false, "", nil
+		}
+		return false, "", err
+	}
+	return true, reason, nil
+}
+
+func UnbanUser(userID string) error {
+	return Client.Del(Ctx, "ban:user:"+userID).Err()
+}
+
+// Device bans key on the signed device cookie, which survives IP changes.
+func BanDevice(deviceID string, duration time.Duration, reason string) error {
+	return Client.Set(Ctx, "ban:device:"+deviceID, reason, duration).Err()
+}
+
+func IsDeviceBanned(ctx context.Context, deviceID string) (bool, string, error) {
+	reason, err := Client.Get(ctx, "ban:device:"+deviceID).Result()
+	if err != nil {
+		if err.Error() == "redis: nil" {
+			return false, "", nil
+		}
+		return false, "", err
+	}
+	return true, reason, nil
+}
+
+func UnbanDevice(deviceID string) error {
+	return Client.Del(Ctx, "ban:device:"+deviceID).Err()
+}
+
+type Ban struct {
+	Kind      string `json:"kind"` // ip, user or device
+	Value     string `json:"value"`
+	Reason    string `json:"reason"`
+	ExpiresAt int64  `json:"expires_at,omitempty"` // zero for permanent bans
+}
+
+func banKey(kind, value string) (string, error) {
+	switch kind {
+	case "ip":
+		return "ban:" + value, nil
+	case "user", "device":
+		return "ban:" + kind + ":" + value, nil
+	}
+	return "", fmt.Errorf("unknown ban kind %q", kind)
+}
+
+// ListBans returns every active IP, user and device ban.
+func ListBans(ctx context.Context) ([]Ban, error) {
+	var bans []Ban
+	iter := Client.Scan(ctx, 0, "ban:*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		ban := Ban{Kind: "ip", Value: strings.TrimPrefix(key, "ban:")}
+		for _, kind := range []string{"user", "device"} {
+			if v, ok := strings.CutPrefix(key, "ban:"+kind+":"); ok {
+				ban.Kind, ban.Value = kind, v
+			}
+		}
+
+		reason, err := Client.Get(ctx, key).Result()
+		if err != nil {
+			continue // expired since the scan
+		}
+		ban.Reason = reason
+		if ttl, err := Client.TTL(ctx, key).Result(); err == nil && ttl > 0 {
+			ban.ExpiresAt = time.Now().Add(ttl).Unix()
+		}
+		bans = append(bans, ban)
+	}
+	return bans, iter.Err()
+}
+
+// Unban lifts a ban of the given kind. It reports whether there was one.
+func Unban(ctx context.Context, kind, value string) (bool, error) {
+	key, err := banKey(kind, value)
+	if err != nil {
+		return false, err
+	}
+	n, err := Client.Del(ctx, key).Result()
+	return n > 0, err
+}
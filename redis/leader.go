@@ -0,0 +1,187 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrNotLeader = errors.New("not the leader")
+
+// Lease elects one server to run singleton jobs. The holder is stored under
+// leader:<name> with a TTL and renewed while its jobs run; when the holder
+// dies the key expires and another server takes over.
+//
+// Every time the lease is won it gets a fencing token from
+// leader:<name>:token, which only ever goes up. The key holds
+// "<owner>:<token>", and leader-only writes check it in the same script
+// that makes them, so a server that stalled past its TTL and woke up again
+// can't write, even if it won an earlier term.
+type Lease struct {
+	key      string
+	tokenKey string
+	owner    string
+	ttl      time.Duration
+	token    atomic.Int64
+}
+
+// acquireScript takes the lease if it is free and returns the new fencing
+// token, or 0.
+var acquireScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+local token = redis.call("INCR", KEYS[2])
+redis.call("SET", KEYS[1], ARGV[1] .. ":" .. token, "PX", ARGV[2])
+return token`)
+
+// renewScript extends the lease only if we still hold it.
+var renewScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// releaseScript deletes the lease only if we still hold it.
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+func NewLease(name, owner string, ttl time.Duration) *Lease {
+	return &Lease{
+		key:      "leader:" + name,
+		tokenKey: "leader:" + name + ":token",
+		owner:    owner,
+		ttl:      ttl,
+	}
+}
+
+// Held reports whether this server thinks it holds the lease. Writes that
+// must not come from a deposed leader go through a fenced script instead.
+func (l *Lease) Held() bool {
+	return l.token.Load() != 0
+}
+
+// fencedScript builds a script that only runs while the caller holds the
+// lease for its term. KEYS[1] and ARGV[1] are the lease key and the value
+// the holder wrote, so body's own keys and arguments start at index 2.
+func fencedScript(body string) *redis.Script {
+	return redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return redis.error_reply("NOTLEADER")
+end
+` + body)
+}
+
+// runFenced runs a fencedScript for the current term. Redis checks the
+// lease and applies the write in one step, so a leader that stalled past
+// its lease gets ErrNotLeader instead of racing its successor.
+func (l *Lease) runFenced(ctx context.Context, script *redis.Script, keys []string, args ...any) (any, error) {
+	token := l.token.Load()
+	if token == 0 {
+		return nil, ErrNotLeader
+	}
+	keys = append([]string{l.key}, keys...)
+	args = append([]any{l.value(token)}, args...)
+	res, err := script.Run(ctx, Client, keys, args...).Result()
+	if err != nil && strings.Contains(err.Error(), "NOTLEADER") {
+		return nil, ErrNotLeader
+	}
+	return res, err
+}
+
+func (l *Lease) value(token int64) string {
+	return l.owner + ":" + strconv.FormatInt(token, 10)
+}
+
+// Run campaigns for the lease until ctx is done. Each time it is won, job
+// runs with a context that is cancelled as soon as the lease is lost. On
+// return the lease is released so another server can take over on its next
+// attempt instead of waiting for it to expire.
+func (l *Lease) Run(ctx context.Context, job func(ctx context.Context)) {
+	retry := time.NewTicker(l.ttl / 3)
+	defer retry.Stop()
+
+	for {
+		token, err := acquireScript.Run(ctx, Client, []string{l.key, l.tokenKey}, l.owner, l.ttl.Milliseconds()).Int64()
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("leader election failed", "lease", l.key, "err", err)
+		}
+		if token != 0 {
+			l.lead(ctx, token, job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-retry.C:
+		}
+	}
+}
+
+// lead runs job and keeps renewing the lease until ctx is done or a renewal
+// fails for good.
+func (l *Lease) lead(ctx context.Context, token int64, job func(ctx context.Context)) {
+	slog.Info("acquired leadership", "lease", l.key, "term", token)
+	l.token.Store(token)
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		job(jobCtx)
+	}()
+
+	l.hold(ctx, token)
+	l.token.Store(0)
+	cancel()
+	<-done
+
+	if ctx.Err() != nil {
+		rctx, rcancel := context.WithTimeout(context.Background(), time.Second)
+		defer rcancel()
+		if err := releaseScript.Run(rctx, Client, []string{l.key}, l.value(token)).Err(); err != nil {
+			slog.Warn("failed to release leadership", "lease", l.key, "err", err)
+		}
+		slog.Info("released leadership", "lease", l.key, "term", token)
+		return
+	}
+	slog.Warn("lost leadership", "lease", l.key, "term", token)
+}
+
+// hold renews the lease every third of its TTL. A renewal that errors is
+// retried, but we give up once the lease may have expired, so two servers
+// never both think they lead for longer than a renewal interval.
+func (l *Lease) hold(ctx context.Context, token int64) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := renewScript.Run(ctx, Client, []string{l.key}, l.value(token), l.ttl.Milliseconds()).Int()
+		switch {
+		case err == nil && n == 1:
+			renewed = time.Now()
+		case err == nil:
+			// someone else holds it now
+			return
+		case time.Since(renewed) >= l.ttl*2/3:
+			slog.Warn("failed to renew leadership", "lease", l.key, "err", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package redis
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+type Report struct {
+	ID        string `json:"id"`
+	ClientID  string `json:"client_id"`
+	IP        string `json:"ip,omitempty"`
+	DeviceID  string `json:"device_id,omitempty"`
+	Reason    string `json:"reason"`
+	Evidence  string `json:"evidence,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+	Resolved  bool   `json:"resolved"`
+}
+
+// CreateReport stores a moderation report under the "reports" hash.
+func CreateReport(ctx context.Context, r Report) (string, error) {
+	if r.ID == "" {
+		r.ID = uuid.NewString()
+	}
+	if r.CreatedAt == 0 {
+		r.CreatedAt = time.Now().Unix()
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+
+	return r.ID, Client.HSet(ctx, "reports", r.ID, b).Err()
+}
+
+// ListReports returns moderation reports, oldest first. Resolved reports
+// are only included if all is set.
+func ListReports(ctx context.Context, all bool) ([]Report, error) {
+	vals, err := Client.HVals(ctx, "reports").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]Report, 0, len(vals))
+	for _, v := range vals {
+		var r Report
+		if err := json.Unmarshal([]byte(v), &r); err != nil {
+			continue
+		}
+		if r.Resolved && !all {
+			continue
+		}
+		reports = append(reports, r)
+	}
+	slices.SortFunc(reports, func(a, b Report) int { return cmp.Compare(a.CreatedAt, b.CreatedAt) })
+	return reports, nil
+}
+
+// ResolveReport marks a report as handled. It reports whether the report
+// exists.
+func ResolveReport(ctx context.Context, id string) (bool, error) {
+	raw, err := Client.HGet(ctx, "reports", id).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var r Report
+	if err := json.Unmarshal([]byte(raw), &r); err != nil {
+		return false, err
+	}
+	r.Resolved = true
+	b, _ := json.Marshal(r)
+	return true, Client.HSet(ctx, "reports", id, b).Err()
+}
@@ -1,10 +1,19 @@
 package redis
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"omiro/tracing"
+	"os"
+	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/trace"
 )
 
 /********************************
@@ -12,31 +21,57 @@ import (
  ********************************/
 
 type ClientMeta struct {
-	ID        string `json:"id"`
-	IP        string `json:"ip"`
-	ServerID  string `json:"server_id"`
-	PartnerID string `json:"partner_id,omitempty"`
-	InQueue   bool   `json:"in_queue"`
+	ID          string `json:"id"`
+	IP          string `json:"ip"`
+	DeviceID    string `json:"device_id,omitempty"`
+	ServerID    string `json:"server_id"`
+	PartnerID   string `json:"partner_id,omitempty"`
+	InQueue     bool   `json:"in_queue"`
+	Mode        string `json:"mode,omitempty"`
+	QueuedAt    int64  `json:"queued_at,omitempty"`
+	ConnectedAt int64  `json:"connected_at"`
+}
+
+// serverClientsKey indexes the clients connected to a server. It sits
+// outside server:* so ListServers only sees heartbeats.
+func serverClientsKey(serverID string) string {
+	return "clients:" + serverID
 }
 
-func RegisterClient(clientID, ip, serverID string) error {
+func RegisterClient(ctx context.Context, clientID, ip, deviceID, serverID string) error {
 	data := ClientMeta{
-		ID:       clientID,
-		IP:       ip,
-		ServerID: serverID,
-		InQueue:  false,
+		ID:          clientID,
+		IP:          ip,
+		DeviceID:    deviceID,
+		ServerID:    serverID,
+		InQueue:     false,
+		ConnectedAt: time.Now().Unix(),
 	}
 
 	b, _ := json.Marshal(data)
 
 	key := "client:" + clientID
-	return Client.Set(Ctx, key, b, 2*time.Hour).Err()
+	pipe := Client.TxPipeline()
+	pipe.Set(ctx, key, b, clientTTL)
+	pipe.SAdd(ctx, serverClientsKey(serverID), clientID)
+	pipe.Expire(ctx, serverClientsKey(serverID), clientTTL)
+	_, err := pipe.Exec(ctx)
+	return err
 }
 
-func GetClient(clientID string) (*ClientMeta, error) {
+// UnregisterClient removes a disconnected client's metadata.
+func UnregisterClient(serverID, clientID string) error {
+	pipe := Client.TxPipeline()
+	pipe.Del(Ctx, "client:"+clientID)
+	pipe.SRem(Ctx, serverClientsKey(serverID), clientID)
+	_, err := pipe.Exec(Ctx)
+	return err
+}
+
+func GetClient(ctx context.Context, clientID string) (*ClientMeta, error) {
 	key := "client:" + clientID
 
-	raw, err := Client.Get(Ctx, key).Result()
+	raw, err := Client.Get(ctx, key).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -49,34 +84,200 @@ func GetClient(clientID string) (*ClientMeta, error) {
 	return &meta, nil
 }
 
+// UpdateClient applies fn to a client's metadata and saves it without
+// touching its TTL. Only the client's own server should call it.
+func UpdateClient(ctx context.Context, clientID string, fn func(*ClientMeta)) error {
+	meta, err := GetClient(ctx, clientID)
+	if err != nil {
+		return err
+	}
+	fn(meta)
+
+	b, _ := json.Marshal(meta)
+	return Client.Set(ctx, "client:"+clientID, b, redis.KeepTTL).Err()
+}
+
+// ServerClients returns the metadata of every client registered on a
+// server. Clients whose metadata has already expired are skipped.
+func ServerClients(ctx context.Context, serverID string) ([]ClientMeta, error) {
+	ids, err := Client.SMembers(ctx, serverClientsKey(serverID)).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = "client:" + id
+	}
+	vals, err := Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]ClientMeta, 0, len(vals))
+	for _, v := range vals {
+		raw, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var meta ClientMeta
+		if err := json.Unmarshal([]byte(raw), &meta); err != nil {
+			continue
+		}
+		out = append(out, meta)
+	}
+	return out, nil
+}
+
 /********************************
  * SERVER REGISTRATION
  ********************************/
 
-func RegisterServer(serverID string) {
+var heartbeatStop = make(chan struct{})
+
+// RegisterServer starts the heartbeat that keeps server:<id> alive. If the
+// key turns out to have lapsed in the meantime (a Redis outage, or a stall
+// longer than the TTL), other servers may already have reaped our clients,
+// so every client restore returns is registered again.
+func RegisterServer(serverID string, restore func() []ClientMeta) {
 	key := "server:" + serverID
 
-	err := Client.Set(Ctx, key, time.Now().Unix(), 60*time.Second).Err()
+	err := Client.Set(Ctx, key, time.Now().Unix(), serverTTL).Err()
 	if err != nil {
-		log.Fatal("failed to register server:", err)
+		slog.Error("failed to register server", "err", err)
+		os.Exit(1)
 	}
 
 	go func() {
-		ticker := time.NewTicker(55 * time.Second)
-		for range ticker.C {
-			Client.Set(Ctx, key, time.Now().Unix(), 60*time.Second)
+		// beat often enough that one failed refresh doesn't let the key lapse
+		ticker := time.NewTicker(serverTTL / 3)
+		defer ticker.Stop()
+		restoring := false
+		for {
+			select {
+			case <-ticker.C:
+				restoring = heartbeat(serverID, restoring, restore)
+			case <-heartbeatStop:
+				return
+			}
 		}
 	}()
 
-	log.Println("Server registered:", serverID)
+	slog.Info("server registered")
+}
+
+// heartbeat refreshes the server key and client index, and re-registers
+// the clients if the key had lapsed or restoring is still pending from an
+// earlier beat. It reports whether a restore is still pending.
+func heartbeat(serverID string, restoring bool, restore func() []ClientMeta) bool {
+	err := Client.SetArgs(Ctx, "server:"+serverID, time.Now().Unix(), redis.SetArgs{TTL: serverTTL, Get: true}).Err()
+	if errors.Is(err, redis.Nil) {
+		slog.Warn("server heartbeat had lapsed, registering clients again")
+		restoring = true
+	} else if err != nil {
+		// we can't tell whether the key survived, so assume it didn't
+		slog.Error("server heartbeat failed", "err", err)
+		return true
+	}
+
+	if restoring {
+		if err := RestoreClients(Ctx, serverID, restore()); err != nil {
+			slog.Error("failed to register clients again", "err", err)
+			return true
+		}
+		return false
+	}
+
+	// keep the client index alive for as long as we are, so the reaper can
+	// find it if we die
+	if err := Client.Expire(Ctx, serverClientsKey(serverID), clientTTL).Err(); err != nil {
+		slog.Error("failed to refresh client index", "err", err)
+	}
+	return false
+}
+
+// RestoreClients writes back the metadata and index entries of clients that
+// are still connected to serverID.
+func RestoreClients(ctx context.Context, serverID string, metas []ClientMeta) error {
+	pipe := Client.TxPipeline()
+	for _, meta := range metas {
+		b, _ := json.Marshal(meta)
+		pipe.Set(ctx, "client:"+meta.ID, b, clientTTL)
+		pipe.SAdd(ctx, serverClientsKey(serverID), meta.ID)
+	}
+	pipe.Expire(ctx, serverClientsKey(serverID), clientTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// UnregisterServer stops the heartbeat and removes the server key so other
+// servers stop routing to it straight away.
+func UnregisterServer(serverID string) error {
+	close(heartbeatStop)
+	return Client.Del(Ctx, "server:"+serverID).Err()
+}
+
+// ListServers returns the IDs of servers whose heartbeat key is still alive.
+func ListServers(ctx context.Context) ([]string, error) {
+	var ids []string
+	iter := Client.Scan(ctx, 0, "server:*", 100).Iterator()
+	for iter.Next(ctx) {
+		ids = append(ids, strings.TrimPrefix(iter.Val(), "server:"))
+	}
+	return ids, iter.Err()
+}
+
+type ServerInfo struct {
+	ID            string `json:"id"`
+	LastHeartbeat int64  `json:"last_heartbeat"`
+	Clients       int64  `json:"clients"`
+}
+
+// ServerInfos returns every live server with its last heartbeat and the
+// number of clients it has registered.
+func ServerInfos(ctx context.Context) ([]ServerInfo, error) {
+	ids, err := ListServers(ctx)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	pipe := Client.Pipeline()
+	beats := make([]*redis.StringCmd, len(ids))
+	counts := make([]*redis.IntCmd, len(ids))
+	for i, id := range ids {
+		beats[i] = pipe.Get(ctx, "server:"+id)
+		counts[i] = pipe.SCard(ctx, serverClientsKey(id))
+	}
+	// a server can expire between SCAN and GET, which shows up as redis.Nil
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	out := make([]ServerInfo, 0, len(ids))
+	for i, id := range ids {
+		beat, err := beats[i].Int64()
+		if err != nil {
+			continue
+		}
+		out = append(out, ServerInfo{ID: id, LastHeartbeat: beat, Clients: counts[i].Val()})
+	}
+	return out, nil
 }
 
 /********************************
  * SEND TO CLIENT (PUBSUB ROUTING)
  ********************************/
 
-func SendToClient(clientID string, payload any) error {
-	meta, err := GetClient(clientID)
+// signalEnvelope wraps everything published on signal:<serverID>. Trace
+// carries the sender's trace context so delivery joins the same trace.
+type signalEnvelope struct {
+	UserID  string            `json:"user_id"`
+	Payload any               `json:"payload"`
+	Trace   map[string]string `json:"trace,omitempty"`
+}
+
+func SendToClient(ctx context.Context, clientID string, payload any) error {
+	meta, err := GetClient(ctx, clientID)
 	if err != nil {
 		return err
 	}
@@ -87,111 +288,168 @@ func SendToClient(clientID string, payload any) error {
 
 	channel := "signal:" + meta.ServerID
 
-	msg := map[string]any{
-		"user_id": clientID,
-		"payload": payload,
+	b, _ := json.Marshal(signalEnvelope{
+		UserID:  clientID,
+		Payload: payload,
+		Trace:   tracing.Inject(ctx),
+	})
+
+	return Client.Publish(ctx, channel, b).Err()
+}
+
+// SendToServer publishes a server-level message to one server. Like
+// Broadcast, it arrives at the signal handler with an empty user ID.
+func SendToServer(ctx context.Context, serverID string, payload any) error {
+	b, _ := json.Marshal(signalEnvelope{
+		Payload: payload,
+		Trace:   tracing.Inject(ctx),
+	})
+	return Client.Publish(ctx, "signal:"+serverID, b).Err()
+}
+
+// Broadcast publishes a server-level message to every live server. It
+// arrives at the signal handler with an empty user ID.
+func Broadcast(ctx context.Context, payload any) error {
+	servers, err := ListServers(ctx)
+	if err != nil {
+		return err
 	}
 
-	b, _ := json.Marshal(msg)
+	b, _ := json.Marshal(signalEnvelope{
+		Payload: payload,
+		Trace:   tracing.Inject(ctx),
+	})
 
-	return Client.Publish(Ctx, channel, b).Err()
+	for _, id := range servers {
+		if err := Client.Publish(ctx, "signal:"+id, b).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 /********************************
  * SIGNAL SUBSCRIBER (WS SERVER)
  ********************************/
 
+var (
+	signalSub        *redis.PubSub
+	signalSubRunning atomic.Bool
+)
+
 // This must be called inside EACH WS server, passing its serverID AND a handler
-func StartSignalSubscriber(serverID string, handler func(userID string, payload json.RawMessage)) {
-	ch := Client.Subscribe(Ctx, "signal:"+serverID).Channel()
+func StartSignalSubscriber(serverID string, handler func(ctx context.Context, userID string, payload json.RawMessage)) error {
+	signalSub = Client.Subscribe(Ctx, "signal:"+serverID)
+	// wait for the subscription to be confirmed so failures show up here
+	if _, err := signalSub.Receive(Ctx); err != nil {
+		signalSub.Close()
+		return fmt.Errorf("failed to subscribe to signals: %w", err)
+	}
+	ch := signalSub.Channel()
 
+	signalSubRunning.Store(true)
 	go func() {
+		defer signalSubRunning.Store(false)
 		for msg := range ch {
 			var incoming struct {
-				UserID  string          `json:"user_id"`
-				Payload json.RawMessage `json:"payload"`
+				UserID  string            `json:"user_id"`
+				Payload json.RawMessage   `json:"payload"`
+				Trace   map[string]string `json:"trace"`
 			}
 
 			if err := json.Unmarshal([]byte(msg.Payload), &incoming); err != nil {
-				log.Println("signal parse error:", err)
+				slog.Warn("signal parse error", "err", err)
 				continue
 			}
 
-			handler(incoming.UserID, incoming.Payload)
+			ctx := tracing.Extract(Ctx, incoming.Trace)
+			if !trace.SpanContextFromContext(ctx).IsValid() {
+				handler(ctx, incoming.UserID, incoming.Payload)
+				continue
+			}
+			ctx, span := tracing.Tracer.Start(ctx, "signal.receive", trace.WithSpanKind(trace.SpanKindConsumer))
+			handler(ctx, incoming.UserID, incoming.Payload)
+			span.End()
 		}
 	}()
+	return nil
 }
 
-/********************************
- * MATCHMAKER
- ********************************/
-
-func StartMatchmaker() {
-	for {
-		u1, _ := Client.RPop(Ctx, "matchmaking:queue").Result()
-		if u1 == "" {
-			time.Sleep(100 * time.Millisecond)
-			continue
-		}
-
-		u2, _ := Client.RPop(Ctx, "matchmaking:queue").Result()
-		if u2 == "" {
-			Client.LPush(Ctx, "matchmaking:queue", u1)
-			time.Sleep(100 * time.Millisecond)
-			continue
-		}
-
-		go createPair(u1, u2)
+// CheckSignalSubscriber returns an error unless the subscriber is running
+// and its connection still accepts a ping.
+func CheckSignalSubscriber() error {
+	if !signalSubRunning.Load() {
+		return fmt.Errorf("signal subscriber not running")
 	}
+	return signalSub.Ping(Ctx)
 }
 
-func createPair(u1, u2 string) {
-	c1, err1 := GetClient(u1)
-	c2, err2 := GetClient(u2)
-
-	if err1 != nil || err2 != nil || c1 == nil || c2 == nil {
-		log.Println("pair error: client not found")
-		return
+// StopSignalSubscriber unsubscribes from this server's signal channel.
+func StopSignalSubscriber() error {
+	if signalSub == nil {
+		return nil
 	}
-
-	// assign
-	c1.PartnerID = u2
-	c2.PartnerID = u1
-
-	// persist
-	b1, _ := json.Marshal(c1)
-	b2, _ := json.Marshal(c2)
-
-	Client.Set(Ctx, "client:"+u1, b1, 2*time.Hour)
-	Client.Set(Ctx, "client:"+u2, b2, 2*time.Hour)
-
-	// notify both
-	SendToClient(u1, map[string]any{
-		"type":       "match_found",
-		"partner_id": u2,
-	})
-
-	SendToClient(u2, map[string]any{
-		"type":       "match_found",
-		"partner_id": u1,
-	})
+	return signalSub.Close()
 }
 
 /********************************
  * RATE LIMIT
  ********************************/
 
-func CheckRateLimit(ip string, limit int, window time.Duration) (bool, error) {
+func CheckRateLimit(ctx context.Context, ip string, limit int, window time.Duration) (bool, error) {
 	key := fmt.Sprintf("ratelimit:%s", ip)
 
-	count, err := Client.Incr(Ctx, key).Result()
+	count, err := Client.Incr(ctx, key).Result()
 	if err != nil {
 		return false, err
 	}
 
 	if count == 1 {
-		Client.Expire(Ctx, key, window)
+		Client.Expire(ctx, key, window)
 	}
 
 	return count <= int64(limit), nil
 }
+
+// RecordRateLimitHit counts a request rejected by the named limiter. The
+// count covers the last minute and is used to judge pressure on the limiter.
+func RecordRateLimitHit(ctx context.Context, name string) error {
+	key := "ratelimit:hits:" + name
+
+	count, err := Client.Incr(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+
+	if count == 1 {
+		Client.Expire(ctx, key, time.Minute)
+	}
+	return nil
+}
+
+// CountMessagePartners records that sender sent the message with the given
+// hash to partner, and returns how many different partners got it within
+// window. It backs the spam filter, so the count follows a sender across
+// reconnects and servers.
+func CountMessagePartners(ctx context.Context, sender, hash, partner string, window time.Duration) (int64, error) {
+	key := "spam:" + sender + ":" + hash
+	now := time.Now()
+
+	pipe := Client.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, key, "-inf", fmt.Sprint(now.Add(-window).UnixMilli()))
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(now.UnixMilli()), Member: partner})
+	count := pipe.ZCard(ctx, key)
+	pipe.Expire(ctx, key, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+func RateLimitHits(ctx context.Context, name string) (int64, error) {
+	count, err := Client.Get(ctx, "ratelimit:hits:"+name).Int64()
+	if err != nil && err.Error() == "redis: nil" {
+		return 0, nil
+	}
+	return count, err
+}
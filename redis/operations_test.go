@@ -0,0 +1,62 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestHeartbeatRestoresReapedClients(t *testing.T) {
+	m := miniredis.RunT(t)
+	if err := Init(Config{Host: m.Host(), Port: m.Port()}); err != nil {
+		t.Fatal(err)
+	}
+
+	const server = "s1"
+	if err := RegisterClient(Ctx, "c1", "203.0.113.7", "d1", server); err != nil {
+		t.Fatal(err)
+	}
+	restore := func() []ClientMeta {
+		return []ClientMeta{{ID: "c1", IP: "203.0.113.7", DeviceID: "d1", ServerID: server, PartnerID: "c2"}}
+	}
+
+	// the heartbeat lapses and the leader reaps us while we are alive
+	leader := NewLease("jobs", "s2", time.Minute)
+	leader.token.Store(1)
+	m.Set(leader.key, leader.value(1))
+	if n, err := ReapServer(Ctx, leader, server); err != nil || n != 1 {
+		t.Fatalf("ReapServer() = %d, %v", n, err)
+	}
+	if m.Exists("client:c1") {
+		t.Fatal("client:c1 survived the reap")
+	}
+
+	if heartbeat(server, false, restore) {
+		t.Fatal("restore still pending after a successful beat")
+	}
+	meta, err := GetClient(Ctx, "c1")
+	if err != nil {
+		t.Fatalf("client:c1 not restored: %v", err)
+	}
+	if meta.PartnerID != "c2" || meta.ServerID != server {
+		t.Fatalf("restored %+v", meta)
+	}
+	if ok, _ := m.SIsMember(serverClientsKey(server), "c1"); !ok {
+		t.Fatal("c1 missing from the client index")
+	}
+	if !m.Exists("server:" + server) {
+		t.Fatal("heartbeat key not set")
+	}
+
+	// a beat that fails leaves the restore pending for the next one
+	m.SetError("LOADING")
+	if !heartbeat(server, false, restore) {
+		t.Fatal("failed beat did not leave a restore pending")
+	}
+	m.SetError("")
+	m.Del("client:c1")
+	if heartbeat(server, true, restore) || !m.Exists("client:c1") {
+		t.Fatal("pending restore was not carried out")
+	}
+}
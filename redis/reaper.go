@@ -0,0 +1,79 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// A server that crashes never unregisters its clients. Its heartbeat key
+// expires, but clients:<id> and the client:<id> keys it indexes stay behind
+// and keep showing up in the admin API and cluster stats. Its queue and
+// pairings lived in its own memory and died with it; pairs never span
+// servers, so there is nobody elsewhere to notify. The reaper finds such
+// servers and deletes what they left in Redis.
+
+// ErrServerAlive is returned by ReapServer when the server's heartbeat came
+// back before it was reaped.
+var ErrServerAlive = errors.New("server is alive")
+
+// reapScript deletes a dead server's client metadata and index in one step,
+// unless its heartbeat has reappeared. It returns the number of client keys
+// deleted, or -1 if the server is alive.
+var reapScript = fencedScript(`
+if redis.call("EXISTS", KEYS[2]) == 1 then
+	return -1
+end
+local n = 0
+for _, id in ipairs(redis.call("SMEMBERS", KEYS[3])) do
+	n = n + redis.call("DEL", "client:" .. id)
+end
+redis.call("DEL", KEYS[3])
+return n`)
+
+// DeadServers returns servers that still have a client index but no
+// heartbeat.
+func DeadServers(ctx context.Context) ([]string, error) {
+	var ids []string
+	iter := Client.Scan(ctx, 0, serverClientsKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		ids = append(ids, strings.TrimPrefix(iter.Val(), serverClientsKey("")))
+	}
+	if err := iter.Err(); err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	pipe := Client.Pipeline()
+	alive := make([]*redis.IntCmd, len(ids))
+	for i, id := range ids {
+		alive[i] = pipe.Exists(ctx, "server:"+id)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	var dead []string
+	for i, id := range ids {
+		if alive[i].Val() == 0 {
+			dead = append(dead, id)
+		}
+	}
+	return dead, nil
+}
+
+// ReapServer deletes a dead server's client metadata and client index, and
+// returns how many clients it removed. It fails with ErrNotLeader unless
+// lease is still held.
+func ReapServer(ctx context.Context, lease *Lease, serverID string) (int, error) {
+	res, err := lease.runFenced(ctx, reapScript, []string{"server:" + serverID, serverClientsKey(serverID)})
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.(int64)
+	if n < 0 {
+		return 0, ErrServerAlive
+	}
+	return int(n), nil
+}
@@ -0,0 +1,40 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// RevokeSession denylists a session ID for ttl, which should cover the
+// token's remaining lifetime.
+func RevokeSession(sessionID string, ttl time.Duration) error {
+	return Client.Set(Ctx, "revoked:session:"+sessionID, time.Now().Unix(), ttl).Err()
+}
+
+// RevokeIP denylists every session issued to ip up to now. Sessions issued
+// afterwards are unaffected.
+func RevokeIP(ip string, ttl time.Duration) error {
+	return Client.Set(Ctx, "revoked:ip:"+ip, time.Now().Unix(), ttl).Err()
+}
+
+func IsSessionRevoked(ctx context.Context, sessionID, ip string, issuedAt int64) (bool, error) {
+	keys := []string{"revoked:session:" + sessionID}
+	if ip != "" {
+		keys = append(keys, "revoked:ip:"+ip)
+	}
+
+	vals, err := Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return false, err
+	}
+
+	if vals[0] != nil {
+		return true, nil
+	}
+	if len(vals) > 1 && vals[1] != nil {
+		revokedAt, _ := strconv.ParseInt(vals[1].(string), 10, 64)
+		return issuedAt <= revokedAt, nil
+	}
+	return false, nil
+}
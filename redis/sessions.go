@@ -0,0 +1,37 @@
+package redis
+
+import (
+	"context"
+	"time"
+)
+
+// MarkSessionUsed records that a session token has been consumed. It returns
+// false if the session was already used. The marker lives until the token
+// would have expired anyway.
+func MarkSessionUsed(ctx context.Context, sessionID string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return false, nil
+	}
+	return Client.SetNX(ctx, "session:used:"+sessionID, 1, ttl).Result()
+}
+
+// MarkChallengeUsed records a redeemed /session/new challenge so the same
+// solution can't mint a second token.
+func MarkChallengeUsed(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return false, nil
+	}
+	return Client.SetNX(ctx, "challenge:used:"+nonce, 1, ttl).Result()
+}
+
+// SaveAuthRequest keeps login state between the redirect to the identity
+// provider and its callback.
+func SaveAuthRequest(state string, data []byte, ttl time.Duration) error {
+	return Client.Set(Ctx, "oidc:state:"+state, data, ttl).Err()
+}
+
+// TakeAuthRequest returns and deletes the login state so a callback can only
+// be completed once.
+func TakeAuthRequest(state string) ([]byte, error) {
+	return Client.GetDel(Ctx, "oidc:state:"+state).Bytes()
+}
@@ -0,0 +1,67 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"omiro/tracing"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingHook records a span per command, but only inside an existing
+// trace so background loops don't flood the exporter with root spans.
+// Arguments are left out as they hold IPs, tokens and chat text.
+type tracingHook struct{}
+
+func (tracingHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (tracingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			return next(ctx, cmd)
+		}
+		ctx, span := startSpan(ctx, "redis."+cmd.Name(), cmd.Name())
+		defer span.End()
+
+		err := next(ctx, cmd)
+		recordError(span, err)
+		return err
+	}
+}
+
+func (tracingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			return next(ctx, cmds)
+		}
+		ctx, span := startSpan(ctx, "redis.pipeline", "pipeline")
+		span.SetAttributes(attribute.Int("db.redis.commands", len(cmds)))
+		defer span.End()
+
+		err := next(ctx, cmds)
+		recordError(span, err)
+		return err
+	}
+}
+
+func startSpan(ctx context.Context, name, op string) (context.Context, trace.Span) {
+	return tracing.Tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "redis"),
+			attribute.String("db.operation", op),
+		),
+	)
+}
+
+func recordError(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, redis.Nil) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
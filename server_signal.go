@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"omiro/redis"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// close codes sent to clients we drop on purpose
+const (
+	closeSessionRevoked = 4001
+	closeKicked         = 4002
+)
+
+// handleServerSignal processes messages published with redis.Broadcast.
+func handleServerSignal(ctx context.Context, payload json.RawMessage) {
+	var msg struct {
+		Op string `json:"op"`
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		slog.Warn("server signal parse error", "err", err)
+		return
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("signal.op", msg.Op))
+
+	switch msg.Op {
+	case "revoke_sessions":
+		handleRevokeSessions(payload)
+	case "kick_client":
+		handleKickClient(payload)
+	case "unpair_client":
+		handleUnpairClient(ctx, payload)
+	case "announce":
+		handleAnnounce(payload)
+	default:
+		slog.Warn("unknown server signal", "op", msg.Op)
+	}
+}
+
+func handleRevokeSessions(payload json.RawMessage) {
+	var msg struct {
+		SessionID string `json:"session_id"`
+		DeviceID  string `json:"device_id"`
+		UserID    string `json:"user_id"`
+		IP        string `json:"ip"`
+		Before    int64  `json:"before"`
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		slog.Warn("invalid payload", "op", "revoke_sessions", "err", err)
+		return
+	}
+
+	var revoked []*Client
+	clientsMu.RLock()
+	for _, c := range clients {
+		s := c.Session
+		if s == nil {
+			continue
+		}
+		if msg.SessionID != "" && s.ID == msg.SessionID {
+			revoked = append(revoked, c)
+		} else if msg.DeviceID != "" && s.DeviceID() == msg.DeviceID {
+			revoked = append(revoked, c)
+		} else if msg.UserID != "" && s.UserID() == msg.UserID {
+			revoked = append(revoked, c)
+		} else if msg.IP != "" && s.Claims["ip"] == msg.IP && s.IssuedAt <= msg.Before {
+			revoked = append(revoked, c)
+		}
+	}
+	clientsMu.RUnlock()
+
+	for _, c := range revoked {
+		c.logger().Info("closing revoked session")
+		c.setCloseReason("revoked")
+		c.kick(closeSessionRevoked, "session revoked")
+	}
+	if len(revoked) > 0 {
+		slog.Info("revoked connections closed", "count", len(revoked))
+	}
+}
+
+// handleKickClient closes a client's connection on an admin's request.
+func handleKickClient(payload json.RawMessage) {
+	var msg struct {
+		ClientID string `json:"client_id"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		slog.Warn("invalid payload", "op", "kick_client", "err", err)
+		return
+	}
+
+	c := safeGetClient(msg.ClientID)
+	if c == nil {
+		return
+	}
+	reason := msg.Reason
+	if reason == "" {
+		reason = "kicked by admin"
+	}
+	c.logger().Info("kicking client", "reason", reason)
+	c.setCloseReason("kicked")
+	c.kick(closeKicked, reason)
+}
+
+// handleUnpairClient ends a client's pairing on an admin's request.
+func handleUnpairClient(ctx context.Context, payload json.RawMessage) {
+	var msg struct {
+		ClientID string `json:"client_id"`
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		slog.Warn("invalid payload", "op", "unpair_client", "err", err)
+		return
+	}
+
+	c := safeGetClient(msg.ClientID)
+	if c == nil || c.Partner == nil {
+		return
+	}
+	partner := c.Partner
+	c.endPairing()
+	partner.endPairing()
+	c.Partner = nil
+	partner.Partner = nil
+
+	c.logger().Info("unpaired by admin", "partner_id", partner.ID)
+	c.enqueue([]byte(`{"op":"partner_disconnected"}`))
+	partner.enqueue([]byte(`{"op":"partner_disconnected"}`))
+	saveClientState(ctx, c, false)
+	saveClientState(ctx, partner, false)
+}
+
+// handleAnnounce shows an operator's announcement to every local client.
+func handleAnnounce(payload json.RawMessage) {
+	var msg struct {
+		Announcement redis.Announcement `json:"announcement"`
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		slog.Warn("invalid payload", "op", "announce", "err", err)
+		return
+	}
+
+	a := msg.Announcement
+	if a.ExpiresAt != 0 && a.ExpiresAt <= time.Now().Unix() {
+		return
+	}
+	b, _ := json.Marshal(announcementMessage(a))
+	for _, c := range localClients() {
+		c.enqueue(b)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"omiro/redis"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// draining is set once shutdown starts. New WebSocket upgrades and queue
+// joins are refused from then on.
+var draining atomic.Bool
+
+// background is cancelled at shutdown to stop background jobs, which
+// register on backgroundJobs so we can wait for them to let go of Redis.
+var (
+	background, stopBackground = context.WithCancel(context.Background())
+	backgroundJobs             sync.WaitGroup
+)
+
+// goBackground runs fn under background.
+func goBackground(fn func(ctx context.Context)) {
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		fn(background)
+	}()
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM, then drains clients and
+// tears the server down. flushTraces sends any spans still buffered.
+func waitForShutdown(e *echo.Echo, flushTraces func(context.Context) error) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	slog.Info("shutting down, draining clients", "signal", sig.String(), "drain_period", cfg.Server.DrainPeriod)
+
+	draining.Store(true)
+	drainClients(cfg.Server.DrainPeriod)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		slog.Error("http shutdown error", "err", err)
+	}
+
+	// give up leadership before going, so another server takes over now
+	// rather than when the lease lapses
+	stopBackground()
+	backgroundJobs.Wait()
+
+	if err := redis.UnregisterServer(serverID); err != nil {
+		slog.Error("failed to unregister server", "err", err)
+	}
+	if err := redis.StopSignalSubscriber(); err != nil {
+		slog.Error("failed to close signal subscriber", "err", err)
+	}
+	redis.Close()
+	if err := flushTraces(ctx); err != nil {
+		slog.Error("failed to flush traces", "err", err)
+	}
+	slog.Info("shutdown complete")
+}
+
+// drainClients asks every client to reconnect elsewhere, waits up to period
+// for them to leave, then closes whoever is left.
+func drainClients(period time.Duration) {
+	deadline := time.Now().Add(period)
+
+	for _, c := range localClients() {
+		sendJSON(c, map[string]any{
+			"op":       "server_draining",
+			"deadline": deadline.Unix(),
+		})
+	}
+
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for time.Now().Before(deadline) && connectedClients() > 0 {
+		<-ticker.C
+	}
+
+	remaining := localClients()
+	for _, c := range remaining {
+		c.setCloseReason("server_shutdown")
+		c.kick(websocket.CloseGoingAway, "server shutting down")
+		// readPump cleans up too, but it may not get there before we exit
+		redis.UnregisterClient(serverID, c.ID)
+	}
+	if len(remaining) > 0 {
+		slog.Info("closed clients still connected after drain", "count", len(remaining))
+	}
+}
+
+// localClients snapshots the connected clients so they can be messaged
+// without holding clientsMu.
+func localClients() []*Client {
+	clientsMu.RLock()
+	defer clientsMu.RUnlock()
+	out := make([]*Client, 0, len(clients))
+	for _, c := range clients {
+		out = append(out, c)
+	}
+	return out
+}
+
+func connectedClients() int {
+	clientsMu.RLock()
+	defer clientsMu.RUnlock()
+	return len(clients)
+}
@@ -0,0 +1,116 @@
+// Package tracing sets up OpenTelemetry and carries trace context across
+// HTTP requests and the Redis pub/sub envelope.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Options struct {
+	// Exporter is none, otlp or stdout.
+	Exporter string
+	// Endpoint is the OTLP/HTTP collector URL, e.g. http://localhost:4318.
+	// Empty falls back to the standard OTEL_EXPORTER_OTLP_* variables.
+	Endpoint    string
+	SampleRatio float64
+	ServiceName string
+	ServerID    string
+}
+
+// Tracer is used for every span Omiro creates. It is a no-op until Setup
+// installs a provider.
+var Tracer = otel.Tracer("omiro")
+
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Setup installs the global tracer provider. The returned function flushes
+// and stops it on shutdown.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch opts.Exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		var o []otlptracehttp.Option
+		if opts.Endpoint != "" {
+			o = append(o, otlptracehttp.WithEndpointURL(opts.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, o...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", opts.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := resource.NewSchemaless(
+		attribute.String("service.name", opts.ServiceName),
+		attribute.String("service.instance.id", opts.ServerID),
+	)
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// StartHTTP starts a server span for r and returns r carrying the new
+// context. Headers come from untrusted clients, so the span always starts a
+// new trace, sampled by our own ratio; a traceparent the caller sent is only
+// recorded as a link, and its baggage is dropped.
+func StartHTTP(r *http.Request, name string) (*http.Request, trace.Span) {
+	opts := []trace.SpanStartOption{
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+		),
+	}
+	remote := trace.SpanContextFromContext(
+		propagation.TraceContext{}.Extract(context.Background(), propagation.HeaderCarrier(r.Header)))
+	if remote.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: remote}))
+	}
+
+	ctx, span := Tracer.Start(r.Context(), name, opts...)
+	return r.WithContext(ctx), span
+}
+
+// Inject returns ctx's trace context as a map for embedding in messages.
+// It is nil when ctx carries no trace.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract continues the trace carried by a map produced by Inject.
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier(carrier))
+}
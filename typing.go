@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	// a client may re-announce typing_start at most this often
+	typingRelayInterval = 3 * time.Second
+	// and relay any typing event at most this often, so alternating
+	// typing_start and typing_stop can't flood the partner either
+	typingMinInterval = time.Second
+	// receipts only reference messages this client actually received
+	maxReceivedIDs    = 200
+	maxReadIDsPerCall = 50
+)
+
+func handleTyping(c *Client, typing bool) {
+	clientsMu.RLock()
+	partner := c.Partner
+	clientsMu.RUnlock()
+	if partner == nil {
+		return
+	}
+
+	c.mu.Lock()
+	now := time.Now()
+	relay := false
+	if typing && c.typingStop != nil {
+		// typing resumed before the deferred typing_stop went out
+		c.typingStop.Stop()
+		c.typingStop = nil
+	}
+	switch {
+	case now.Sub(c.lastTyping) < typingMinInterval:
+		// too soon after the last relayed event; a typing_stop is held
+		// back until the interval is up rather than dropped, or the
+		// partner would see the indicator until the next message
+		if !typing && c.typing && c.typingStop == nil {
+			c.typingStop = time.AfterFunc(c.lastTyping.Add(typingMinInterval).Sub(now), c.flushTypingStop)
+		}
+	case typing:
+		// repeated typing_start within the interval is dropped
+		relay = !c.typing || now.Sub(c.lastTyping) >= typingRelayInterval
+	default:
+		// typing_stop only means something after a typing_start
+		relay = c.typing
+	}
+	// c.typing tracks what the partner was last told, so a dropped
+	// typing_stop still goes through when the client sends it again
+	if relay {
+		c.typing = typing
+		c.lastTyping = now
+	}
+	c.mu.Unlock()
+
+	if !relay {
+		return
+	}
+
+	op := "typing_stop"
+	if typing {
+		op = "typing_start"
+	}
+	sendJSON(partner, map[string]any{"op": op})
+}
+
+// flushTypingStop relays a typing_stop deferred by handleTyping, unless
+// the client typed again or the pairing changed in the meantime.
+func (c *Client) flushTypingStop() {
+	c.mu.Lock()
+	c.typingStop = nil
+	relay := c.typing
+	if relay {
+		c.typing = false
+		c.lastTyping = time.Now()
+	}
+	c.mu.Unlock()
+	if !relay {
+		return
+	}
+
+	clientsMu.RLock()
+	partner := c.Partner
+	clientsMu.RUnlock()
+	if partner != nil {
+		sendJSON(partner, map[string]any{"op": "typing_stop"})
+	}
+}
+
+func handleChatRead(c *Client, data json.RawMessage) {
+	var payload struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		c.logger().Warn("invalid payload", "op", "chat_read", "err", err)
+		return
+	}
+
+	clientsMu.RLock()
+	partner := c.Partner
+	clientsMu.RUnlock()
+	if partner == nil {
+		return
+	}
+
+	if len(payload.IDs) > maxReadIDsPerCall {
+		payload.IDs = payload.IDs[:maxReadIDsPerCall]
+	}
+
+	// only relay IDs the partner sent us, and only once each
+	var ids []string
+	c.mu.Lock()
+	for _, id := range payload.IDs {
+		if c.takeReceived(id) {
+			ids = append(ids, id)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(ids) == 0 {
+		return
+	}
+
+	sendJSON(partner, map[string]any{
+		"op":  "chat_read",
+		"ids": ids,
+	})
+}
+
+// rememberReceived records a message ID delivered to c. Caller holds c.mu.
+func (c *Client) rememberReceived(id string) {
+	c.received = append(c.received, id)
+	if len(c.received) > maxReceivedIDs {
+		c.received = c.received[len(c.received)-maxReceivedIDs:]
+	}
+}
+
+// takeReceived reports whether id was delivered to c and forgets it so a
+// receipt can't be replayed. Caller holds c.mu.
+func (c *Client) takeReceived(id string) bool {
+	for i, r := range c.received {
+		if r == id {
+			c.received = append(c.received[:i], c.received[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// resetChatState clears per-pairing chat state when the partner changes.
+func (c *Client) resetChatState() {
+	c.mu.Lock()
+	c.typing = false
+	if c.typingStop != nil {
+		c.typingStop.Stop()
+		c.typingStop = nil
+	}
+	c.received = nil
+	c.mu.Unlock()
+}
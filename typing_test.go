@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// typingPair returns a paired client and the channel its partner receives on.
+func typingPair() (*Client, chan SendMessageType) {
+	partner := &Client{ID: "p", Send: make(chan SendMessageType, 8)}
+	c := &Client{ID: "c", Send: make(chan SendMessageType, 8), Partner: partner}
+	partner.Partner = c
+	return c, partner.Send
+}
+
+func nextOp(t *testing.T, ch chan SendMessageType, wait time.Duration) string {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		var m struct{ Op string }
+		if err := json.Unmarshal(msg.Message, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m.Op
+	case <-time.After(wait):
+		return ""
+	}
+}
+
+func TestTypingStopWithinIntervalIsDelayed(t *testing.T) {
+	c, partner := typingPair()
+
+	start := time.Now()
+	handleTyping(c, true)
+	if op := nextOp(t, partner, 100*time.Millisecond); op != "typing_start" {
+		t.Fatalf("got %q, want typing_start", op)
+	}
+	handleTyping(c, false)
+	handleTyping(c, false)
+
+	if op := nextOp(t, partner, typingMinInterval/2); op != "" {
+		t.Fatalf("got %q before the interval was up", op)
+	}
+	if op := nextOp(t, partner, typingMinInterval); op != "typing_stop" {
+		t.Fatalf("got %q, want typing_stop", op)
+	}
+	if elapsed := time.Since(start); elapsed < typingMinInterval {
+		t.Fatalf("typing_stop after %v, before the interval", elapsed)
+	}
+	if op := nextOp(t, partner, typingMinInterval/2); op != "" {
+		t.Fatalf("got %q after the stop, want nothing", op)
+	}
+}
+
+func TestTypingStartCancelsDelayedStop(t *testing.T) {
+	c, partner := typingPair()
+
+	handleTyping(c, true)
+	nextOp(t, partner, 100*time.Millisecond)
+	handleTyping(c, false)
+	handleTyping(c, true)
+
+	if op := nextOp(t, partner, typingMinInterval+typingMinInterval/2); op != "" {
+		t.Fatalf("got %q, want the partner to still see typing", op)
+	}
+}